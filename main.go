@@ -37,11 +37,42 @@ func LoadConfig(configPath string) (*synapse.Synapse, error) {
 	return conf, nil
 }
 
-func waitForSignal() {
+// return true if a reload is requested
+func waitForSignal() bool {
 	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGKILL, syscall.SIGTERM)
-	<-sigs
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGKILL, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sigs)
+	if sig := <-sigs; sig == syscall.SIGHUP {
+		logs.Debug("Reload signal received")
+		return true
+	}
 	logs.Debug("Stop signal received")
+	return false
+}
+
+func ReloadConfig(configPath string, current *synapse.Synapse, logLevelIsSet bool, oneshot bool) *synapse.Synapse {
+	fields := data.WithField("file", configPath)
+	logs.WithF(fields).Info("Reloading configuration")
+
+	conf, err := LoadConfig(configPath)
+	if err != nil {
+		logs.WithEF(err, fields).Error("Failed to load configuration, keeping current one")
+		return current
+	}
+	if err := conf.Init(Version, BuildTime, logLevelIsSet); err != nil {
+		logs.WithEF(err, fields).Error("Failed to init reloaded configuration, keeping current one")
+		return current
+	}
+
+	current.Stop()
+	if err := conf.Start(oneshot); err != nil {
+		logs.WithEF(err, fields).Error("Failed to start reloaded configuration, restarting current one")
+		if err := current.Start(oneshot); err != nil {
+			logs.WithEF(err, fields).Fatal("Failed to restart synapse with current configuration")
+		}
+		return current
+	}
+	return conf
 }
 
 //func trace() {
@@ -119,7 +150,9 @@ func main() {
 			if err := synapse.Start(oneshot); err != nil {
 				logs.WithE(err).Fatal("Failed to start synapse")
 			}
-			waitForSignal()
+			for waitForSignal() {
+				synapse = ReloadConfig(args[0], synapse, logLevel != "", oneshot)
+			}
 			synapse.Stop()
 		},
 	}
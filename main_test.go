@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func freeTestPort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestReloadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "synapse-reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configPath := filepath.Join(dir, "synapse.yml")
+	destination := filepath.Join(dir, "servers")
+	apiPort := freeTestPort(t)
+
+	writeConfig := func(apiPort int, host string) {
+		config := `apiHost: 127.0.0.1
+apiPort: ` + strconv.Itoa(apiPort) + `
+routers:
+  - type: template
+    destinationFile: ` + destination + `
+    template: "{{range .}}{{range .Reports}}{{.Host}}{{end}}{{end}}"
+    eventsBufferDurationInMilli: 1
+    services:
+      - name: api
+        watcher:
+          type: static
+          servers: [{host: ` + host + `, port: 80}]
+`
+		if err := ioutil.WriteFile(configPath, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitDestination := func(expected string) {
+		content := ""
+		for i := 0; i < 50 && content != expected; i++ {
+			time.Sleep(100 * time.Millisecond)
+			c, _ := ioutil.ReadFile(destination)
+			content = strings.TrimSpace(string(c))
+		}
+		if content != expected {
+			t.Fatalf("destination should be %s, was '%s'", expected, content)
+		}
+	}
+
+	writeConfig(apiPort, "10.0.0.1")
+	current, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := current.Init(Version, BuildTime, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := current.Start(false); err != nil {
+		t.Fatal(err)
+	}
+	waitDestination("10.0.0.1")
+
+	writeConfig(apiPort, "10.0.0.2")
+	reloaded := ReloadConfig(configPath, current, true, false)
+	if reloaded == current {
+		t.Fatal("valid configuration should replace current one")
+	}
+	waitDestination("10.0.0.2")
+
+	// api port of the new configuration is already in use
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	writeConfig(listener.Addr().(*net.TCPAddr).Port, "10.0.0.3")
+	if kept := ReloadConfig(configPath, reloaded, true, false); kept != reloaded {
+		t.Fatal("configuration failing to start should keep current one")
+	}
+	defer reloaded.Stop()
+	resp, err := http.Get("http://127.0.0.1:" + strconv.Itoa(apiPort) + "/version")
+	if err != nil {
+		t.Fatalf("current configuration should be restarted: %v", err)
+	}
+	resp.Body.Close()
+}
@@ -0,0 +1,206 @@
+package synapse
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpointv3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	listenerv3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	// filters usable in listeners of routerOptions
+	_ "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/router/v3"
+	_ "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	_ "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/tcp_proxy/v3"
+)
+
+type EnvoyRouterOptions struct {
+	// merged over the generated cluster
+	Cluster   json.RawMessage
+	Listeners []json.RawMessage
+}
+
+type envoyRouterOptions struct {
+	cluster   *clusterv3.Cluster
+	listeners []*listenerv3.Listener
+}
+
+// resources of the services of an envoy router, by service NameWithId
+type envoyResources map[string]envoyServiceResources
+
+type envoyServiceResources struct {
+	cluster   *clusterv3.Cluster
+	endpoints *endpointv3.ClusterLoadAssignment
+	listeners []*listenerv3.Listener
+}
+
+// clusters are named after their service, so a name cannot be used by two services
+func (e envoyResources) set(service *Service, resources envoyServiceResources) error {
+	for id, other := range e {
+		if id != service.NameWithId() && other.cluster.Name == service.Name {
+			return errs.WithF(service.fields, "Another service is already using this cluster name")
+		}
+	}
+	e[service.NameWithId()] = resources
+	return nil
+}
+
+// resources of a type sorted by name
+func (e envoyResources) ofType(typeUrl string) []types.Resource {
+	byName := make(map[string]types.Resource)
+	for _, resources := range e {
+		switch typeUrl {
+		case resource.ClusterType:
+			byName[resources.cluster.Name] = resources.cluster
+		case resource.EndpointType:
+			byName[resources.endpoints.ClusterName] = resources.endpoints
+		case resource.ListenerType:
+			for _, listener := range resources.listeners {
+				byName[listener.Name] = listener
+			}
+		}
+	}
+
+	names := []string{}
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	res := []types.Resource{}
+	for _, name := range names {
+		res = append(res, byName[name])
+	}
+	return res
+}
+
+func checkEnvoyClusterNames(services []*Service, fields data.Fields) error {
+	names := make(map[string]struct{}, len(services))
+	for _, service := range services {
+		if _, ok := names[service.Name]; ok {
+			return errs.WithF(fields.WithField("service", service.Name), "Service names must be unique, they are used as cluster names")
+		}
+		names[service.Name] = struct{}{}
+	}
+	return nil
+}
+
+func envoyServiceResourcesOf(report ServiceReport, connectTimeoutInMilli int, edsConfig *corev3.ConfigSource) envoyServiceResources {
+	resources := envoyServiceResources{
+		cluster:   envoyCluster(report, connectTimeoutInMilli, edsConfig),
+		endpoints: envoyClusterLoadAssignment(report),
+	}
+	if report.Service.typedRouterOptions != nil {
+		resources.listeners = report.Service.typedRouterOptions.(envoyRouterOptions).listeners
+	}
+	return resources
+}
+
+func envoyCluster(report ServiceReport, connectTimeoutInMilli int, edsConfig *corev3.ConfigSource) *clusterv3.Cluster {
+	cluster := &clusterv3.Cluster{
+		Name:                 report.Service.Name,
+		ClusterDiscoveryType: &clusterv3.Cluster_Type{Type: clusterv3.Cluster_EDS},
+		ConnectTimeout:       durationpb.New(time.Duration(connectTimeoutInMilli) * time.Millisecond),
+		EdsClusterConfig: &clusterv3.Cluster_EdsClusterConfig{
+			ServiceName: report.Service.Name,
+			EdsConfig:   edsConfig,
+		},
+	}
+	if report.Service.typedRouterOptions != nil {
+		if options := report.Service.typedRouterOptions.(envoyRouterOptions); options.cluster != nil {
+			proto.Merge(cluster, options.cluster)
+		}
+	}
+	return cluster
+}
+
+func envoyClusterLoadAssignment(report ServiceReport) *endpointv3.ClusterLoadAssignment {
+	endpoints := []*endpointv3.LbEndpoint{}
+	for _, server := range report.Reports {
+		endpoint := &endpointv3.LbEndpoint{
+			HostIdentifier: &endpointv3.LbEndpoint_Endpoint{
+				Endpoint: &endpointv3.Endpoint{
+					Address: &corev3.Address{
+						Address: &corev3.Address_SocketAddress{
+							SocketAddress: &corev3.SocketAddress{
+								Address:       server.Host,
+								PortSpecifier: &corev3.SocketAddress_PortValue{PortValue: uint32(server.Port)},
+							},
+						},
+					},
+				},
+			},
+			HealthStatus: envoyHealthStatus(server),
+		}
+		if server.Weight != nil && *server.Weight > 0 {
+			endpoint.LoadBalancingWeight = wrapperspb.UInt32(uint32(*server.Weight))
+		}
+		if len(server.Labels) > 0 {
+			labels := make(map[string]interface{}, len(server.Labels))
+			for key, value := range server.Labels {
+				labels[key] = value
+			}
+			if metadata, err := structpb.NewStruct(labels); err == nil {
+				endpoint.Metadata = &corev3.Metadata{FilterMetadata: map[string]*structpb.Struct{"synapse": metadata}}
+			}
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+
+	return &endpointv3.ClusterLoadAssignment{
+		ClusterName: report.Service.Name,
+		Endpoints:   []*endpointv3.LocalityLbEndpoints{{LbEndpoints: endpoints}},
+	}
+}
+
+func envoyHealthStatus(report Report) corev3.HealthStatus {
+	if report.Available != nil && !*report.Available {
+		return corev3.HealthStatus_UNHEALTHY
+	}
+	// nerve weight 0 means the server is draining
+	if report.Weight != nil && *report.Weight == 0 {
+		return corev3.HealthStatus_DRAINING
+	}
+	return corev3.HealthStatus_HEALTHY
+}
+
+// cluster and listeners are envoy v3 resources in json
+func parseEnvoyRouterOptions(content []byte, fields data.Fields) (interface{}, error) {
+	fields = fields.WithField("content", string(content))
+	routerOptions := EnvoyRouterOptions{}
+	if err := json.Unmarshal(content, &routerOptions); err != nil {
+		return nil, errs.WithEF(err, fields, "Failed to Unmarshal routerOptions")
+	}
+
+	options := envoyRouterOptions{}
+	if len(routerOptions.Cluster) > 0 {
+		options.cluster = &clusterv3.Cluster{}
+		if err := protojson.Unmarshal(routerOptions.Cluster, options.cluster); err != nil {
+			return nil, errs.WithEF(err, fields, "Invalid cluster in routerOptions")
+		}
+	}
+	for _, content := range routerOptions.Listeners {
+		listener := &listenerv3.Listener{}
+		if err := protojson.Unmarshal(content, listener); err != nil {
+			return nil, errs.WithEF(err, fields, "Invalid listener in routerOptions")
+		}
+		if err := listener.Validate(); err != nil {
+			return nil, errs.WithEF(err, fields, "Invalid listener in routerOptions")
+		}
+		if listener.Name == "" {
+			return nil, errs.WithF(fields, "Listener name is mandatory")
+		}
+		options.listeners = append(options.listeners, listener)
+	}
+	return options, nil
+}
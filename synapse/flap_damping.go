@@ -0,0 +1,152 @@
+package synapse
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+	"github.com/n0rad/go-erlog/logs"
+)
+
+const flapPenalty = 1000
+
+// same as bgp route dampening: each flap adds a penalty that decays exponentially.
+// a server is suppressed above suppressThreshold until its penalty decays under reuseThreshold
+type FlapDamping struct {
+	SuppressThreshold  float64
+	ReuseThreshold     float64
+	HalfLifeInMilli    int
+	MaxSuppressInMilli int
+
+	mutex      sync.Mutex
+	servers    map[string]*serverDamping
+	maxPenalty float64
+}
+
+type serverDamping struct {
+	available  bool
+	penalty    float64
+	updated    time.Time
+	suppressed bool
+}
+
+func (f *FlapDamping) Init(fields data.Fields) error {
+	if f.SuppressThreshold == 0 {
+		f.SuppressThreshold = 3000
+	}
+	if f.ReuseThreshold == 0 {
+		f.ReuseThreshold = 750
+	}
+	if f.HalfLifeInMilli == 0 {
+		f.HalfLifeInMilli = 60000
+	}
+	if f.MaxSuppressInMilli == 0 {
+		f.MaxSuppressInMilli = 4 * f.HalfLifeInMilli
+	}
+
+	fields = fields.WithField("flapDamping", f)
+	if f.ReuseThreshold <= 0 || f.SuppressThreshold <= f.ReuseThreshold {
+		return errs.WithF(fields, "suppressThreshold must be greater than reuseThreshold")
+	}
+	if f.HalfLifeInMilli < 0 || f.MaxSuppressInMilli < 0 {
+		return errs.WithF(fields, "Durations must be positive")
+	}
+
+	// penalty that decays to reuseThreshold in maxSuppressInMilli
+	f.maxPenalty = f.ReuseThreshold * math.Pow(2, float64(f.MaxSuppressInMilli)/float64(f.HalfLifeInMilli))
+	if f.servers == nil {
+		f.servers = make(map[string]*serverDamping)
+	}
+	return nil
+}
+
+func (f *FlapDamping) decay(server *serverDamping, now time.Time) {
+	elapsed := now.Sub(server.updated).Seconds() * 1000
+	server.penalty = server.penalty * math.Pow(0.5, elapsed/float64(f.HalfLifeInMilli))
+	server.updated = now
+}
+
+func (f *FlapDamping) apply(reports []Report, now time.Time, s *Service) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	seen := make(map[string]struct{}, len(reports))
+	for i, report := range reports {
+		seen[report.Name] = struct{}{}
+		available := report.Available == nil || *report.Available
+		server, ok := f.servers[report.Name]
+		if !ok {
+			server = &serverDamping{available: available, updated: now}
+			f.servers[report.Name] = server
+		}
+		f.update(report.Name, server, available, now, s.fields)
+
+		if server.suppressed {
+			suppressed := false
+			reports[i].Available = &suppressed
+			reports[i].UnavailableReason = "flap damping"
+		}
+	}
+
+	// a removed server is a flap to unavailable
+	for name, server := range f.servers {
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		f.update(name, server, false, now, s.fields)
+		if !server.suppressed && server.penalty < 1 {
+			delete(f.servers, name)
+			s.synapse.serverDampingPenalty.DeleteLabelValues(s.Name, name)
+		}
+	}
+
+	for name, server := range f.servers {
+		s.synapse.serverDampingPenalty.WithLabelValues(s.Name, name).Set(server.penalty)
+	}
+}
+
+func (f *FlapDamping) update(name string, server *serverDamping, available bool, now time.Time, fields data.Fields) {
+	f.decay(server, now)
+	if server.available != available {
+		server.available = available
+		server.penalty = math.Min(server.penalty+flapPenalty, f.maxPenalty)
+	}
+
+	fields = fields.WithField("server", name).WithField("penalty", int(server.penalty))
+	if !server.suppressed && server.penalty >= f.SuppressThreshold {
+		server.suppressed = true
+		logs.WithF(fields).Warn("Server is flapping. Suppressing it")
+	} else if server.suppressed && server.penalty < f.ReuseThreshold {
+		server.suppressed = false
+		logs.WithF(fields).Info("Server is stable again. Reusing it")
+	}
+}
+
+// a suppressed server can be reused without new report
+func (f *FlapDamping) needsReevaluation(now time.Time) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, server := range f.servers {
+		if !server.suppressed {
+			continue
+		}
+		elapsed := now.Sub(server.updated).Seconds() * 1000
+		if server.penalty*math.Pow(0.5, elapsed/float64(f.HalfLifeInMilli)) < f.ReuseThreshold {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *FlapDamping) status(name string) (float64, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	server, ok := f.servers[name]
+	if !ok {
+		return 0, false
+	}
+	elapsed := time.Since(server.updated).Seconds() * 1000
+	return server.penalty * math.Pow(0.5, elapsed/float64(f.HalfLifeInMilli)), server.suppressed
+}
@@ -0,0 +1,52 @@
+package synapse
+
+import (
+	"testing"
+	"time"
+
+	"github.com/blablacar/go-nerve/nerve"
+	"github.com/n0rad/go-erlog/data"
+)
+
+func TestFlapDampingSuppressAndReuse(t *testing.T) {
+	s := &Synapse{}
+	s.Init("version", "buildtime", true)
+	service := &Service{Name: "ServiceA", synapse: s, fields: data.WithField("service", "ServiceA")}
+
+	f := &FlapDamping{HalfLifeInMilli: 1000}
+	if err := f.Init(service.fields); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	report := func(available bool) []Report {
+		return []Report{{Report: nerve.Report{Name: "a", Available: &available}}}
+	}
+	for i := 0; i < 4; i++ {
+		reports := report(i%2 == 1)
+		f.apply(reports, now, service)
+	}
+	reports := report(true)
+	f.apply(reports, now, service)
+	if *reports[0].Available || !f.servers["a"].suppressed {
+		t.Errorf("flapping server should be suppressed, was %v", f.servers["a"])
+	}
+
+	if f.needsReevaluation(now.Add(time.Second)) {
+		t.Error("server should still be suppressed after 1 half-life")
+	}
+	if !f.needsReevaluation(now.Add(3 * time.Second)) {
+		t.Error("server should be reusable after 3 half-lives")
+	}
+	reports = report(true)
+	f.apply(reports, now.Add(3*time.Second), service)
+	if !*reports[0].Available || f.servers["a"].suppressed {
+		t.Errorf("stable server should be reused, was %v", f.servers["a"])
+	}
+
+	f.apply([]Report{}, now.Add(time.Minute), service)
+	f.apply([]Report{}, now.Add(time.Hour), service)
+	if _, ok := f.servers["a"]; ok {
+		t.Error("removed server should be forgotten once penalty decayed")
+	}
+}
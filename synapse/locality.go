@@ -0,0 +1,113 @@
+package synapse
+
+import (
+	"os"
+	"strings"
+
+	"github.com/blablacar/go-nerve/nerve"
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+	"github.com/n0rad/go-erlog/logs"
+)
+
+const LOCALITY_BACKUP = "backup"
+const LOCALITY_WEIGHT = "weight"
+
+// prefer servers of the local zone, remote ones are used as backup or with a reduced weight
+type Locality struct {
+	Label                    string
+	Zone                     string
+	ZoneEnv                  string
+	Mode                     string
+	RemoteWeightPercent      int
+	MinLocalAvailablePercent int
+
+	fallback bool
+}
+
+func (l *Locality) Init(fields data.Fields) error {
+	if l.Label == "" {
+		l.Label = "zone"
+	}
+	if l.Mode == "" {
+		l.Mode = LOCALITY_BACKUP
+	}
+	if l.RemoteWeightPercent == 0 {
+		l.RemoteWeightPercent = 10
+	}
+	if l.MinLocalAvailablePercent == 0 {
+		l.MinLocalAvailablePercent = 50
+	}
+	if l.Zone == "" && l.ZoneEnv != "" {
+		l.Zone = os.Getenv(l.ZoneEnv)
+	}
+
+	fields = fields.WithField("locality", l)
+	if l.Zone == "" {
+		return errs.WithF(fields, "Local zone is empty")
+	}
+	if l.Mode != LOCALITY_BACKUP && l.Mode != LOCALITY_WEIGHT {
+		return errs.WithF(fields, "Unsupported locality mode")
+	}
+	if l.RemoteWeightPercent < 0 || l.RemoteWeightPercent > 100 {
+		return errs.WithF(fields, "remoteWeightPercent must be between 0 and 100")
+	}
+	if l.MinLocalAvailablePercent < 0 || l.MinLocalAvailablePercent > 100 {
+		return errs.WithF(fields, "minLocalAvailablePercent must be between 0 and 100")
+	}
+	return nil
+}
+
+func (l *Locality) isLocal(report Report) bool {
+	return report.Labels[l.Label] == l.Zone
+}
+
+func (l *Locality) apply(reports []Report, fields data.Fields) {
+	var local, localAvailable int
+	for _, report := range reports {
+		if l.isLocal(report) {
+			local++
+			if report.Available == nil || *report.Available {
+				localAvailable++
+			}
+		}
+	}
+
+	fallback := local == 0 || localAvailable*100 < local*l.MinLocalAvailablePercent
+	if fallback != l.fallback {
+		fields = fields.WithField("zone", l.Zone).WithField("local", local).WithField("localAvailable", localAvailable)
+		if fallback {
+			logs.WithF(fields).Warn("Not enough local servers available. Using all zones")
+		} else {
+			logs.WithF(fields).Info("Enough local servers available. Preferring local zone")
+		}
+		l.fallback = fallback
+	}
+	if fallback {
+		return
+	}
+
+	for i, report := range reports {
+		if l.Mode == LOCALITY_WEIGHT {
+			weight := uint8(100)
+			if report.Weight != nil {
+				weight = *report.Weight
+			}
+			// weight 0 means draining, a reduced weight must not reach it
+			if !l.isLocal(report) && weight > 0 {
+				weight = uint8(int(weight) * l.RemoteWeightPercent / 100)
+				if weight == 0 {
+					weight = 1
+				}
+			}
+			reports[i].Weight = &weight
+		} else if !l.isLocal(report) {
+			reports[i].Report = withHaProxyServerOption(report.Report, "backup")
+		}
+	}
+}
+
+func withHaProxyServerOption(report nerve.Report, option string) nerve.Report {
+	report.HaProxyServerOptions = strings.TrimSpace(report.HaProxyServerOptions + " " + option)
+	return report
+}
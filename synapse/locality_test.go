@@ -0,0 +1,47 @@
+package synapse
+
+import (
+	"testing"
+
+	"github.com/blablacar/go-nerve/nerve"
+	"github.com/n0rad/go-erlog/data"
+)
+
+func localityTestReport(name string, zone string, available bool) Report {
+	return Report{Report: nerve.Report{Name: name, Available: &available, Labels: map[string]string{"zone": zone}}}
+}
+
+func TestLocalityApply(t *testing.T) {
+	l := &Locality{Zone: "a"}
+	if err := l.Init(data.Fields{}); err != nil {
+		t.Fatal(err)
+	}
+
+	reports := []Report{localityTestReport("a1", "a", true), localityTestReport("a2", "a", true), localityTestReport("b1", "b", true)}
+	l.apply(reports, data.Fields{})
+	if reports[0].HaProxyServerOptions != "" || reports[2].HaProxyServerOptions != "backup" {
+		t.Errorf("remote server should be backup, was %v", reports)
+	}
+
+	reports = []Report{localityTestReport("a1", "a", true), localityTestReport("a2", "a", false), localityTestReport("a3", "a", false), localityTestReport("b1", "b", true)}
+	l.apply(reports, data.Fields{})
+	if !l.fallback || reports[3].HaProxyServerOptions != "" {
+		t.Errorf("should fallback to all zones, was %v", reports)
+	}
+
+	l.Mode = LOCALITY_WEIGHT
+	reports = []Report{localityTestReport("a1", "a", true), localityTestReport("b1", "b", true)}
+	reports[1].Weight = uint8Ptr(50)
+	l.apply(reports, data.Fields{})
+	if l.fallback || *reports[0].Weight != 100 || *reports[1].Weight != 5 {
+		t.Errorf("remote server should have a reduced weight, was %v", reports)
+	}
+
+	reports = []Report{localityTestReport("a1", "a", true), localityTestReport("b1", "b", true), localityTestReport("b2", "b", true)}
+	reports[1].Weight = uint8Ptr(5)
+	reports[2].Weight = uint8Ptr(0)
+	l.apply(reports, data.Fields{})
+	if *reports[1].Weight != 1 || *reports[2].Weight != 0 {
+		t.Errorf("small remote weight should not be drained and draining one should stay drained, was %d %d", *reports[1].Weight, *reports[2].Weight)
+	}
+}
@@ -0,0 +1,62 @@
+package synapse
+
+import (
+	"time"
+
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+)
+
+const NO_ACTIVE_KEEP_LAST = "keepLast"
+const NO_ACTIVE_PUBLISH_EMPTY = "publishEmpty"
+const NO_ACTIVE_KEEP_LAST_FOR = "keepLastFor"
+
+// what to do with a report without active server
+type NoActiveServer struct {
+	Policy             string
+	KeepLastForInMilli int
+
+	since     time.Time
+	published bool
+}
+
+func (n *NoActiveServer) Init(fields data.Fields) error {
+	if n.Policy == "" {
+		n.Policy = NO_ACTIVE_KEEP_LAST
+	}
+	fields = fields.WithField("noActiveServer", n)
+	switch n.Policy {
+	case NO_ACTIVE_KEEP_LAST, NO_ACTIVE_PUBLISH_EMPTY:
+	case NO_ACTIVE_KEEP_LAST_FOR:
+		if n.KeepLastForInMilli <= 0 {
+			return errs.WithF(fields, "keepLastForInMilli must be positive")
+		}
+	default:
+		return errs.WithF(fields, "Unsupported noActiveServer policy")
+	}
+	return nil
+}
+
+// true when the report without active server must be given to the router
+func (n *NoActiveServer) publish(now time.Time) bool {
+	if n.since.IsZero() {
+		n.since = now
+	}
+	switch n.Policy {
+	case NO_ACTIVE_PUBLISH_EMPTY:
+		n.published = true
+	case NO_ACTIVE_KEEP_LAST_FOR:
+		n.published = !now.Before(n.since.Add(time.Duration(n.KeepLastForInMilli) * time.Millisecond))
+	}
+	return n.published
+}
+
+func (n *NoActiveServer) reset() {
+	n.since = time.Time{}
+	n.published = false
+}
+
+func (n *NoActiveServer) needsReevaluation(now time.Time) bool {
+	return n.Policy == NO_ACTIVE_KEEP_LAST_FOR && !n.since.IsZero() && !n.published &&
+		!now.Before(n.since.Add(time.Duration(n.KeepLastForInMilli)*time.Millisecond))
+}
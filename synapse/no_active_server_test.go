@@ -0,0 +1,40 @@
+package synapse
+
+import (
+	"testing"
+	"time"
+
+	"github.com/n0rad/go-erlog/data"
+)
+
+func TestNoActiveServerKeepLastFor(t *testing.T) {
+	n := NoActiveServer{Policy: NO_ACTIVE_KEEP_LAST_FOR, KeepLastForInMilli: 1000}
+	if err := n.Init(data.Fields{}); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	if n.publish(now) {
+		t.Error("should keep last report first")
+	}
+	if n.needsReevaluation(now.Add(500 * time.Millisecond)) {
+		t.Error("should not reevaluate before keepLastFor")
+	}
+	if !n.needsReevaluation(now.Add(time.Second)) || !n.publish(now.Add(time.Second)) {
+		t.Error("should publish after keepLastFor")
+	}
+	if n.needsReevaluation(now.Add(2 * time.Second)) {
+		t.Error("should not reevaluate once published")
+	}
+
+	n.reset()
+	if n.publish(now.Add(3 * time.Second)) {
+		t.Error("should keep last report again after active servers")
+	}
+
+	for _, policy := range []NoActiveServer{{Policy: "unknown"}, {Policy: NO_ACTIVE_KEEP_LAST_FOR}} {
+		if err := policy.Init(data.Fields{}); err == nil {
+			t.Errorf("%v should fail", policy)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package synapse
+
+import (
+	"time"
+
+	"github.com/n0rad/go-erlog/data"
+)
+
+const PANIC_KEEP_LAST = "keepLast"
+const PANIC_ENABLE_ALL = "enableAll"
+
+// reason of the panic, empty when the report is safe to apply
+func (s *Service) panicReason(event ServiceReport, last *ServiceReport) (string, data.Fields) {
+	if last == nil || (s.MinHealthyPercent == 0 && s.MaxRemovalPercent == 0) {
+		return "", nil
+	}
+
+	available, _ := event.AvailableUnavailable()
+	lastAvailable, _ := last.AvailableUnavailable()
+	total := len(event.Reports) + len(vanishedReports(event, *last))
+	fields := s.fields.WithField("available", available).WithField("total", total).WithField("lastAvailable", lastAvailable)
+
+	if s.MinHealthyPercent > 0 && available*100 < total*s.MinHealthyPercent {
+		return "minHealthyPercent", fields.WithField("minHealthyPercent", s.MinHealthyPercent)
+	}
+	if s.MaxRemovalPercent > 0 && (lastAvailable-available)*100 > lastAvailable*s.MaxRemovalPercent {
+		return "maxRemovalPercent", fields.WithField("maxRemovalPercent", s.MaxRemovalPercent)
+	}
+	return "", nil
+}
+
+// a scale down is not distinguishable from a glitch, so previous report is not kept forever
+func (s *Service) panicExpired(now time.Time) bool {
+	return s.panicking && s.PanicKeepLastForInMilli > 0 &&
+		now.Sub(s.panicSince) >= time.Duration(s.PanicKeepLastForInMilli)*time.Millisecond
+}
+
+// like envoy panic mode, all known servers are used
+func enableAllReports(event ServiceReport, last *ServiceReport) ServiceReport {
+	reports := []Report{}
+	for _, report := range append(event.Reports, vanishedReports(event, *last)...) {
+		available := true
+		report.Available = &available
+		reports = append(reports, report)
+	}
+	return ServiceReport{Service: event.Service, Reports: reports}
+}
+
+func vanishedReports(event ServiceReport, last ServiceReport) []Report {
+	names := make(map[string]struct{}, len(event.Reports))
+	for _, report := range event.Reports {
+		names[report.Name] = struct{}{}
+	}
+	vanished := []Report{}
+	for _, report := range last.Reports {
+		// removed servers are kept unavailable in last report
+		if report.Available != nil && !*report.Available {
+			continue
+		}
+		if _, ok := names[report.Name]; !ok {
+			vanished = append(vanished, report)
+		}
+	}
+	return vanished
+}
@@ -0,0 +1,92 @@
+package synapse
+
+import (
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/blablacar/go-nerve/nerve"
+)
+
+func panicTestReports(available int, unavailable int) []Report {
+	reports := []Report{}
+	for i := 0; i < available+unavailable; i++ {
+		a := i < available
+		reports = append(reports, Report{Report: nerve.Report{Name: string('a' + rune(i)), Available: &a}})
+	}
+	return reports
+}
+
+func TestServicePanicReason(t *testing.T) {
+	s := &Service{Name: "ServiceA", MinHealthyPercent: 50, MaxRemovalPercent: 30}
+	last := &ServiceReport{Service: s, Reports: panicTestReports(10, 0)}
+
+	if reason, _ := s.panicReason(ServiceReport{Service: s, Reports: panicTestReports(8, 2)}, last); reason != "" {
+		t.Errorf("losing 2 servers should not panic, was %s", reason)
+	}
+	if reason, _ := s.panicReason(ServiceReport{Service: s, Reports: panicTestReports(4, 6)}, last); reason != "minHealthyPercent" {
+		t.Errorf("having 4 servers available on 10 should panic, was %s", reason)
+	}
+	if reason, _ := s.panicReason(ServiceReport{Service: s, Reports: panicTestReports(6, 0)}, last); reason != "maxRemovalPercent" {
+		t.Errorf("removing 4 servers should panic, was %s", reason)
+	}
+	if reason, _ := s.panicReason(ServiceReport{Service: s, Reports: panicTestReports(4, 0)}, last); reason != "minHealthyPercent" {
+		t.Errorf("removed servers should count in total, was %s", reason)
+	}
+
+	event := enableAllReports(ServiceReport{Service: s, Reports: panicTestReports(2, 2)}, last)
+	if available, unavailable := event.AvailableUnavailable(); available != 10 || unavailable != 0 {
+		t.Errorf("all servers should be enabled, was %d/%d", available, unavailable)
+	}
+}
+
+func TestRouterPanicKeepLastExpiry(t *testing.T) {
+	s := &Synapse{}
+	s.Init("version", "buildtime", true)
+
+	service := &Service{
+		Name:                    "ServiceA",
+		Watcher:                 []byte(`{"type": "static", "servers": [{"host": "10.0.0.1", "port": 80}]}`),
+		MaxRemovalPercent:       30,
+		PanicKeepLastForInMilli: 50,
+	}
+	r := NewRouterConsole()
+	r.writer = ioutil.Discard
+	r.Services = []*Service{service}
+	if err := r.Init(s); err != nil {
+		t.Fatal(err)
+	}
+
+	r.handleReport([]ServiceReport{{Service: service, Reports: panicTestReports(10, 0)}}, r)
+	r.handleReport([]ServiceReport{{Service: service, Reports: panicTestReports(5, 0)}}, r)
+	if available, _ := r.lastEvents[service.NameWithId()].AvailableUnavailable(); available != 10 {
+		t.Errorf("scale down should be kept as a panic, was %d available", available)
+	}
+
+	// no other watcher event after the scale down
+	stop := make(chan struct{})
+	waiter := sync.WaitGroup{}
+	waiter.Add(1)
+	go r.reevaluateServices(stop, &waiter, r)
+	defer func() {
+		close(stop)
+		waiter.Wait()
+	}()
+
+	available := 0
+	for i := 0; i < 30 && available != 5; i++ {
+		time.Sleep(100 * time.Millisecond)
+		r.updateMutex.Lock()
+		available, _ = r.lastEvents[service.NameWithId()].AvailableUnavailable()
+		r.updateMutex.Unlock()
+	}
+	if available != 5 {
+		t.Errorf("scale down should be applied after panicKeepLastForInMilli, was %d available", available)
+	}
+	r.updateMutex.Lock()
+	defer r.updateMutex.Unlock()
+	if service.panicking {
+		t.Error("service should not be panicking anymore")
+	}
+}
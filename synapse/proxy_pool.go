@@ -0,0 +1,206 @@
+package synapse
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+	"github.com/n0rad/go-erlog/logs"
+)
+
+const PROXY_BALANCE_ROUND_ROBIN = "roundRobin"
+const PROXY_BALANCE_LEAST_CONN = "leastConn"
+const PROXY_BALANCE_WEIGHTED = "weighted"
+
+// available servers of a service, used by the proxy routers
+type serverPool struct {
+	balance      string
+	drainTimeout time.Duration
+	fields       data.Fields
+
+	mutex   sync.Mutex
+	servers []*poolServer
+	next    int
+}
+
+type poolServer struct {
+	name    string
+	address string
+	weight  int
+	current int
+	active  int
+	removed bool
+	conns   map[*proxyConnection]struct{}
+}
+
+type proxyConnection struct {
+	client   net.Conn
+	upstream net.Conn
+}
+
+func newServerPool(balance string, drainTimeout time.Duration, fields data.Fields) (*serverPool, error) {
+	if balance == "" {
+		balance = PROXY_BALANCE_ROUND_ROBIN
+	}
+	switch balance {
+	case PROXY_BALANCE_ROUND_ROBIN, PROXY_BALANCE_LEAST_CONN, PROXY_BALANCE_WEIGHTED:
+	default:
+		return nil, errs.WithF(fields.WithField("balance", balance), "Unsupported balance")
+	}
+	return &serverPool{balance: balance, drainTimeout: drainTimeout, fields: fields}, nil
+}
+
+func (p *serverPool) update(reports []Report) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	known := make(map[string]*poolServer, len(p.servers))
+	for _, server := range p.servers {
+		known[server.name] = server
+	}
+
+	servers := []*poolServer{}
+	for _, report := range reports {
+		if report.Available != nil && !*report.Available {
+			continue
+		}
+		weight := 100
+		if report.Weight != nil {
+			weight = int(*report.Weight)
+		}
+		// nerve weight 0 means the server is draining
+		if weight == 0 {
+			continue
+		}
+		address := net.JoinHostPort(report.Host, strconv.Itoa(int(report.Port)))
+		server, ok := known[report.Name]
+		if !ok || server.address != address {
+			server = &poolServer{name: report.Name, address: address, conns: make(map[*proxyConnection]struct{})}
+		} else {
+			delete(known, report.Name)
+		}
+		server.weight = weight
+		servers = append(servers, server)
+	}
+	p.servers = servers
+
+	for _, server := range known {
+		server.removed = true
+		p.drain(server)
+	}
+}
+
+// existing connections of a removed server are kept until drainTimeout
+func (p *serverPool) drain(server *poolServer) {
+	if len(server.conns) == 0 {
+		return
+	}
+	fields := p.fields.WithField("server", server.name).WithField("connections", len(server.conns))
+	logs.WithF(fields).Debug("Draining server")
+	if p.drainTimeout <= 0 {
+		return
+	}
+	time.AfterFunc(p.drainTimeout, func() {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		for conn := range server.conns {
+			conn.client.Close()
+			conn.upstream.Close()
+		}
+	})
+}
+
+func (p *serverPool) drainAll() {
+	p.update([]Report{})
+}
+
+// next server to use, excluded servers are skipped
+func (p *serverPool) pick(excluded func(server *poolServer) bool) *poolServer {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	candidates := []*poolServer{}
+	for i := range p.servers {
+		server := p.servers[(p.next+i)%len(p.servers)]
+		if excluded == nil || !excluded(server) {
+			candidates = append(candidates, server)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	p.next = (p.next + 1) % len(p.servers)
+
+	switch p.balance {
+	case PROXY_BALANCE_LEAST_CONN:
+		best := candidates[0]
+		for _, server := range candidates[1:] {
+			if server.active < best.active {
+				best = server
+			}
+		}
+		return best
+	case PROXY_BALANCE_WEIGHTED:
+		// smooth weighted round robin, same as nginx
+		var best *poolServer
+		total := 0
+		for _, server := range candidates {
+			server.current += server.weight
+			total += server.weight
+			if best == nil || server.current > best.current {
+				best = server
+			}
+		}
+		best.current -= total
+		return best
+	default:
+		return candidates[0]
+	}
+}
+
+// a removed server is not acquired, since it is already drained
+func (p *serverPool) acquire(server *poolServer, conn *proxyConnection) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if server.removed {
+		return false
+	}
+	server.active++
+	if conn != nil {
+		server.conns[conn] = struct{}{}
+	}
+	return true
+}
+
+func (p *serverPool) release(server *poolServer, conn *proxyConnection) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	server.active--
+	if conn != nil {
+		delete(server.conns, conn)
+	}
+}
+
+// copy both ways until both sides are done
+func (c *proxyConnection) pipe() {
+	done := make(chan struct{}, 2)
+	copyAndCloseWrite := func(dst net.Conn, src net.Conn) {
+		io.Copy(dst, src)
+		if tcp, ok := dst.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		} else {
+			dst.Close()
+		}
+		done <- struct{}{}
+	}
+	go copyAndCloseWrite(c.upstream, c.client)
+	go copyAndCloseWrite(c.client, c.upstream)
+	<-done
+	<-done
+	c.client.Close()
+	c.upstream.Close()
+}
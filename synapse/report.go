@@ -5,7 +5,9 @@ import (
 	"github.com/blablacar/go-nerve/nerve"
 	"github.com/n0rad/go-erlog/data"
 	"github.com/n0rad/go-erlog/logs"
+	"reflect"
 	"sync"
+	"time"
 )
 
 const PrometheusLabelContent = "content"
@@ -20,12 +22,32 @@ type reportMap struct {
 type Report struct {
 	nerve.Report
 	CreationTime int64
+	// last update of the report by its source, in ms, 0 when unknown
+	ModificationTime int64
 }
 
 func (r Report) String() string {
 	return r.Report.String()
 }
 
+// creation time for watchers whose source does not provide one
+type firstSeenTimes map[string]int64
+
+func (f firstSeenTimes) get(name string) int64 {
+	if _, ok := f[name]; !ok {
+		f[name] = time.Now().UnixNano() / int64(time.Millisecond)
+	}
+	return f[name]
+}
+
+func (f firstSeenTimes) retain(reports map[string]Report) {
+	for name := range f {
+		if _, ok := reports[name]; !ok {
+			delete(f, name)
+		}
+	}
+}
+
 func NewReportMap(service *Service) *reportMap {
 	n := reportMap{
 		service: service,
@@ -42,15 +64,37 @@ func (n *reportMap) setNoNodes() {
 	n.changed <- struct{}{}
 }
 
-func (n *reportMap) addRawReport(name string, content []byte, failFields data.Fields, creationTime int64) {
+func (n *reportMap) parseRawReport(content []byte, failFields data.Fields) (nerve.Report, bool) {
 	r := nerve.Report{}
 	if err := json.Unmarshal(content, &r); err != nil {
 		n.service.synapse.watcherFailures.WithLabelValues(n.service.Name, PrometheusLabelContent).Inc()
 		logs.WithEF(err, failFields.WithField("content", string(content))).Warn("Failed to unmarshal report")
+		return r, false
+	}
+	return r, true
+}
+
+func (n *reportMap) addRawReport(name string, content []byte, failFields data.Fields, creationTime int64, modificationTime int64) {
+	r, ok := n.parseRawReport(content, failFields)
+	if !ok {
 		return
 	}
+	n.addReport(name, Report{Report: r, CreationTime: creationTime, ModificationTime: modificationTime})
+}
+
+func (n *reportMap) addReport(name string, report Report) {
 	n.Lock()
-	n.m[name] = Report{r, creationTime}
+	n.m[name] = report
+	n.Unlock()
+	n.changed <- struct{}{}
+}
+
+func (n *reportMap) replaceAll(reports map[string]Report) {
+	n.Lock()
+	n.m = make(map[string]Report, len(reports))
+	for k, v := range reports {
+		n.m[k] = v
+	}
 	n.Unlock()
 	n.changed <- struct{}{}
 }
@@ -71,6 +115,12 @@ func (n *reportMap) removeNode(name string) {
 	n.changed <- struct{}{}
 }
 
+func (n *reportMap) sameAs(reports map[string]Report) bool {
+	n.RLock()
+	defer n.RUnlock()
+	return reflect.DeepEqual(n.m, reports)
+}
+
 func (n *reportMap) get(name string) (Report, bool) {
 	n.RLock()
 	defer n.RUnlock()
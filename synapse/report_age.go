@@ -0,0 +1,55 @@
+package synapse
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/n0rad/go-erlog/logs"
+)
+
+// last update of the report, from reportTimestampLabel or from its source (zookeeper mtime...)
+func (s *Service) reportUpdateTime(report Report) time.Time {
+	if s.ReportTimestampLabel != "" {
+		if value, ok := report.Labels[s.ReportTimestampLabel]; ok {
+			if ms, err := strconv.ParseInt(value, 10, 64); err == nil {
+				return time.Unix(0, ms*int64(time.Millisecond))
+			}
+			if t, err := time.Parse(time.RFC3339, value); err == nil {
+				return t
+			}
+			logs.WithF(s.fields.WithField("server", report.Name).WithField("timestamp", value)).Debug("Invalid report timestamp")
+		}
+	}
+	if report.ModificationTime == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, report.ModificationTime*int64(time.Millisecond))
+}
+
+// reports older than maxReportAgeInMilli are unavailable
+func (s *Service) expireReports(reports []Report, now time.Time) {
+	s.nextReportExpiry = time.Time{}
+	if s.MaxReportAgeInMilli <= 0 {
+		return
+	}
+
+	for i, report := range reports {
+		updated := s.reportUpdateTime(report)
+		if updated.IsZero() {
+			continue
+		}
+		expiry := updated.Add(time.Duration(s.MaxReportAgeInMilli) * time.Millisecond)
+		if now.Before(expiry) {
+			if s.nextReportExpiry.IsZero() || expiry.Before(s.nextReportExpiry) {
+				s.nextReportExpiry = expiry
+			}
+			continue
+		}
+		if report.Available == nil || *report.Available {
+			logs.WithF(s.fields.WithField("server", report.Name).WithField("updated", updated)).Debug("Report is too old")
+			available := false
+			reports[i].Available = &available
+			reports[i].UnavailableReason = "report is too old"
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package synapse
+
+import (
+	"testing"
+	"time"
+
+	"github.com/blablacar/go-nerve/nerve"
+	"github.com/n0rad/go-erlog/data"
+)
+
+func TestServiceExpireReports(t *testing.T) {
+	s := &Service{Name: "ServiceA", MaxReportAgeInMilli: 10000, ReportTimestampLabel: "timestamp", fields: data.WithField("service", "ServiceA")}
+	now := time.Now()
+	ms := func(t time.Time) int64 {
+		return t.UnixNano() / int64(time.Millisecond)
+	}
+
+	reports := []Report{
+		{Report: nerve.Report{Name: "fresh"}, ModificationTime: ms(now.Add(-5 * time.Second))},
+		{Report: nerve.Report{Name: "old"}, ModificationTime: ms(now.Add(-20 * time.Second))},
+		{Report: nerve.Report{Name: "label", Labels: map[string]string{"timestamp": now.Add(-time.Minute).Format(time.RFC3339)}}, ModificationTime: ms(now)},
+		{Report: nerve.Report{Name: "unknown"}},
+	}
+	s.expireReports(reports, now)
+
+	for i, expected := range []bool{true, false, false, true} {
+		if available := reports[i].Available == nil || *reports[i].Available; available != expected {
+			t.Errorf("%s should be available %t", reports[i].Name, expected)
+		}
+	}
+	if s.nextReportExpiry.Sub(now) < 4*time.Second || s.nextReportExpiry.Sub(now) > 6*time.Second {
+		t.Errorf("next expiry should be in 5s, was %s", s.nextReportExpiry.Sub(now))
+	}
+}
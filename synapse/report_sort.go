@@ -53,6 +53,8 @@ func (n *ReportSortType) UnmarshalJSON(d []byte) error {
 	}
 
 	switch strings.ToLower(s) {
+	case "":
+		*n = ""
 	case string(SORT_RANDOM):
 		*n = SORT_RANDOM
 	case string(SORT_NAME):
@@ -13,16 +13,24 @@ import (
 	"github.com/n0rad/go-erlog/logs"
 )
 
+// routers serving traffic themselves report failures to listen with this suffix
+const PrometheusLabelListenSuffix = "_listen"
+
 type RouterCommon struct {
 	Type                        string
 	EventsBufferDurationInMilli int
 	Services                    []*Service
 
-	synapse    *Synapse
-	lastEvents map[string]*ServiceReport
-	fields     data.Fields
+	synapse       *Synapse
+	lastEvents    map[string]*ServiceReport
+	fields        data.Fields
+	servicesMutex sync.RWMutex
+	updateMutex   sync.Mutex
 }
 
+// on configuration reload the new routers are initialized while the current ones are still running,
+// then the current ones are stopped and the new ones run. Init must have no side effect, binding or
+// writing files is done in Run and Update
 type Router interface {
 	Init(s *Synapse) error
 	getFields() data.Fields
@@ -32,9 +40,13 @@ type Router interface {
 	ServicesNames() []string
 	ParseServerOptions(data []byte) (interface{}, error)
 	ParseRouterOptions(data []byte) (interface{}, error)
+	addService(service *Service)
+	removeService(service *Service) error
 }
 
 func (r *RouterCommon) ServicesNames() []string {
+	r.servicesMutex.RLock()
+	defer r.servicesMutex.RUnlock()
 	keys := make([]string, len(r.Services))
 
 	i := 0
@@ -69,20 +81,36 @@ func (r *RouterCommon) RunCommon(context *ContextImpl, router Router) {
 
 	events := make(chan ServiceReport)
 	watcherContext := newContext(context.oneshot)
-	for _, service := range r.Services {
-		go service.typedWatcher.Watch(watcherContext, events, service)
+	r.servicesMutex.RLock()
+	services := append([]*Service{}, r.Services...)
+	r.servicesMutex.RUnlock()
+	for _, service := range services {
+		watcherContext.doneWaiter.Add(1)
+		go func(service *Service) {
+			defer watcherContext.doneWaiter.Done()
+			service.typedWatcher.Watch(watcherContext, events, service)
+		}(service)
 	}
 
-	go r.eventsProcessor(events, router)
+	eventsStop := make(chan struct{})
+	go r.eventsProcessor(events, eventsStop, router)
+
+	reevaluateStop := make(chan struct{})
+	reevaluateWaiter := sync.WaitGroup{}
+	reevaluateWaiter.Add(1)
+	go r.reevaluateServices(reevaluateStop, &reevaluateWaiter, router)
 
 	<-context.stop
+	close(reevaluateStop)
+	reevaluateWaiter.Wait()
 	close(watcherContext.stop)
 	watcherContext.doneWaiter.Wait()
 	logs.WithF(r.fields).Debug("All Watchers stopped")
-	close(events)
+	// events is not closed, a stopped watcher may still be reporting
+	close(eventsStop)
 }
 
-func (r *RouterCommon) eventsProcessor(events chan ServiceReport, router Router) {
+func (r *RouterCommon) eventsProcessor(events chan ServiceReport, stop <-chan struct{}, router Router) {
 	updateMutex := sync.Mutex{}
 	bufEvents := make(map[string]ServiceReport)
 	var eventsTimer *time.Timer
@@ -102,11 +130,9 @@ func (r *RouterCommon) eventsProcessor(events chan ServiceReport, router Router)
 
 	for {
 		select {
-		case event, ok := <-events:
-			if !ok {
-				return
-			}
-
+		case <-stop:
+			return
+		case event := <-events:
 			logs.WithF(r.fields.WithField("event", event)).Debug("Router received an event")
 			if eventsTimer != nil && !eventsTimer.Stop() {
 				logs.WithF(r.fields.WithField("event", event)).Trace("Event Already fired")
@@ -122,8 +148,62 @@ func (r *RouterCommon) eventsProcessor(events chan ServiceReport, router Router)
 	}
 }
 
-func (r *RouterCommon) handleReport(events []ServiceReport, router Router) {
+func (r *RouterCommon) handleReport(allEvents []ServiceReport, router Router) {
+	r.updateMutex.Lock()
+	defer r.updateMutex.Unlock()
+	r.updateRouter(allEvents, router)
+}
+
+// some service policies change reports without watcher event, like flap damping reuse
+func (r *RouterCommon) reevaluateServices(stop <-chan struct{}, doneWaiter *sync.WaitGroup, router Router) {
+	defer doneWaiter.Done()
+	for {
+		select {
+		case <-time.After(time.Second):
+		case <-stop:
+			return
+		}
+
+		r.updateMutex.Lock()
+		now := time.Now()
+		events := []ServiceReport{}
+		r.servicesMutex.RLock()
+		for _, service := range r.Services {
+			if service.needsReevaluation(now) {
+				events = append(events, ServiceReport{Service: service, Reports: service.watcherReports()})
+			}
+		}
+		r.servicesMutex.RUnlock()
+		if len(events) > 0 {
+			logs.WithF(r.fields.WithField("events", events)).Debug("Reevaluating services")
+			r.updateRouter(events, router)
+		}
+		r.updateMutex.Unlock()
+	}
+}
+
+// updateMutex must be hold
+func (r *RouterCommon) updateRouter(allEvents []ServiceReport, router Router) {
 	validEvents := []ServiceReport{}
+	events := []ServiceReport{}
+	for _, event := range allEvents {
+		if event.Service.removed {
+			logs.WithF(event.Service.fields).Debug("Dropping report of removed service")
+			continue
+		}
+		selected, excluded := event.Service.typedSelector.filter(event.Reports)
+		event.Reports = selected
+		event.Service.setServers(selected, excluded)
+		r.synapse.serviceExcludedCount.WithLabelValues(event.Service.Name).Set(float64(len(excluded)))
+		event.Service.expireReports(event.Reports, time.Now())
+		if event.Service.Locality != nil {
+			event.Service.Locality.apply(event.Reports, event.Service.fields)
+		}
+		if event.Service.FlapDamping != nil {
+			event.Service.FlapDamping.apply(event.Reports, time.Now(), event.Service)
+		}
+		events = append(events, event)
+	}
 
 	for _, event := range events {
 		event.Service.ServerSort.Sort(&event.Reports)
@@ -134,15 +214,45 @@ func (r *RouterCommon) handleReport(events []ServiceReport, router Router) {
 		r.synapse.serviceAvailableCount.WithLabelValues(event.Service.Name).Set(float64(available))
 		r.synapse.serviceUnavailableCount.WithLabelValues(event.Service.Name).Set(float64(unavailable))
 
+		publishEmpty := false
 		if !event.HasActiveServers() {
-			if r.lastEvents[event.Service.NameWithId()] == nil {
+			if event.Service.NoActiveServer.publish(time.Now()) {
+				logs.WithF(event.Service.fields.WithField("policy", event.Service.NoActiveServer.Policy)).Warn("Receiving report with no active server. Publishing it")
+				publishEmpty = true
+			} else if r.lastEvents[event.Service.NameWithId()] == nil {
 				logs.WithF(event.Service.fields).Warn("First Report has no active server. Not declaring in router")
+				continue
 			} else {
 				logs.WithF(event.Service.fields).Error("Receiving report with no active server. Keeping previous report")
+				continue
 			}
-			continue
-		} else if r.lastEvents[event.Service.NameWithId()] == nil || r.lastEvents[event.Service.NameWithId()].HasActiveServers() != event.HasActiveServers() {
-			logs.WithF(event.Service.fields.WithField("event", event)).Info("Server(s) available for router")
+		} else {
+			event.Service.NoActiveServer.reset()
+			if r.lastEvents[event.Service.NameWithId()] == nil || r.lastEvents[event.Service.NameWithId()].HasActiveServers() != event.HasActiveServers() {
+				logs.WithF(event.Service.fields.WithField("event", event)).Info("Server(s) available for router")
+			}
+		}
+
+		if reason, fields := event.Service.panicReason(event, r.lastEvents[event.Service.NameWithId()]); reason != "" && !publishEmpty {
+			r.synapse.servicePanics.WithLabelValues(event.Service.Name, reason).Inc()
+			if !event.Service.panicking {
+				event.Service.panicSince = time.Now()
+			}
+			event.Service.panicking = true
+			if event.Service.PanicMode == PANIC_ENABLE_ALL {
+				logs.WithF(fields.WithField("reason", reason)).Error("Panic threshold reached. Enabling all servers")
+				event = enableAllReports(event, r.lastEvents[event.Service.NameWithId()])
+			} else if event.Service.panicExpired(time.Now()) {
+				logs.WithF(fields.WithField("reason", reason).WithField("since", event.Service.panicSince)).
+					Warn("Panic threshold reached for too long. Applying report")
+				event.Service.panicking = false
+			} else {
+				logs.WithF(fields.WithField("reason", reason)).Error("Panic threshold reached. Keeping previous report")
+				continue
+			}
+		} else if event.Service.panicking {
+			logs.WithF(event.Service.fields).Info("Panic threshold not reached anymore")
+			event.Service.panicking = false
 		}
 
 		validEvents = append(validEvents, r.FilterCorrelations(event, events))
@@ -169,7 +279,7 @@ func (r *RouterCommon) handleReport(events []ServiceReport, router Router) {
 			}
 			if !found {
 				validEvents[i].Reports = append(event.Reports, Report{
-					nerve.Report{
+					Report: nerve.Report{
 						Available:            &found,
 						UnavailableReason:    lastReport.UnavailableReason,
 						Host:                 lastReport.Host,
@@ -179,7 +289,8 @@ func (r *RouterCommon) handleReport(events []ServiceReport, router Router) {
 						Weight:               lastReport.Weight,
 						Labels:               lastReport.Labels,
 					},
-					lastReport.CreationTime,
+					CreationTime:     lastReport.CreationTime,
+					ModificationTime: lastReport.ModificationTime,
 				})
 			}
 		}
@@ -209,11 +320,8 @@ func (r *RouterCommon) FilterCorrelations(current ServiceReport, serviceReports
 			break
 		}
 	}
-	if correlatedServiceRepr == "" {
-		return current
-	}
 
-	filtered := r.FilterCorrelation(current, r.lastEvents[current.Service.ServerCorrelation.OtherServiceName])
+	filtered := r.FilterCorrelation(current, r.lastEvents[correlatedServiceRepr])
 	for _, SameUpdateReports2 := range serviceReports {
 		if current.Service.ServerCorrelation.OtherServiceName == SameUpdateReports2.Service.Name {
 			logs.WithF(r.fields.WithField("current", current)).Debug("Found other correlation service in same report")
@@ -229,11 +337,12 @@ func (r *RouterCommon) FilterCorrelation(reports ServiceReport, otherServiceRepo
 		return reports
 	}
 
+	correlation := reports.Service.ServerCorrelation
 	res := []Report{}
 	for _, report := range reports.Reports {
-		// TODO support other filter
-		if len(otherServiceReport.Reports) > 0 && report.Name == otherServiceReport.Reports[0].Name {
-			logs.WithF(r.fields.WithField("server", report.Name)).Debug("Removing correlated server")
+		matches := correlation.matches(report, otherServiceReport.Reports)
+		if matches != (correlation.Type == CORRELATION_INCLUDE_ONLY) {
+			logs.WithF(r.fields.WithField("server", report.Name).WithField("correlation", correlation.Type)).Debug("Removing correlated server")
 			continue
 		}
 		res = append(res, report)
@@ -241,6 +350,32 @@ func (r *RouterCommon) FilterCorrelation(reports ServiceReport, otherServiceRepo
 	return ServiceReport{reports.Service, res}
 }
 
+func (c ServerCorrelation) matches(report Report, others []Report) bool {
+	if c.Scope == CORRELATION_SCOPE_FIRST {
+		return len(others) > 0 && report.Name == others[0].Name
+	}
+	for _, other := range others {
+		if other.Available != nil && !*other.Available {
+			continue
+		}
+		switch c.Scope {
+		case CORRELATION_SCOPE_ALL:
+			if report.Name == other.Name {
+				return true
+			}
+		case CORRELATION_SCOPE_HOST:
+			if report.Host == other.Host {
+				return true
+			}
+		case CORRELATION_SCOPE_LABEL:
+			if value, ok := report.Labels[c.Label]; ok && value == other.Labels[c.Label] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (r *RouterCommon) getFields() data.Fields {
 	return r.fields
 }
@@ -256,8 +391,18 @@ func RouterFromJson(content []byte, s *Synapse) (Router, error) {
 	switch t.Type {
 	case "console":
 		typedRouter = NewRouterConsole()
+	case "envoy":
+		typedRouter = NewRouterEnvoy()
+	case "envoyfile":
+		typedRouter = NewRouterEnvoyFile()
 	case "haproxy":
 		typedRouter = NewRouterHaProxy()
+	case "httpproxy":
+		typedRouter = NewRouterHttpProxy()
+	case "nginx":
+		typedRouter = NewRouterNginx()
+	case "proxy":
+		typedRouter = NewRouterProxy()
 	case "template":
 		typedRouter = NewRouterTemplate()
 	default:
@@ -275,6 +420,8 @@ func RouterFromJson(content []byte, s *Synapse) (Router, error) {
 }
 
 func (r *RouterCommon) GetService(name string) (*Service, error) {
+	r.servicesMutex.RLock()
+	defer r.servicesMutex.RUnlock()
 	for _, s := range r.Services {
 		if s.Name == name {
 			return s, nil
@@ -283,3 +430,33 @@ func (r *RouterCommon) GetService(name string) (*Service, error) {
 	return nil, errs.WithF(r.fields.WithField("name", name), "Cannot found service with this name")
 
 }
+
+// services created at runtime, by a zookeeper glob watcher
+func (r *RouterCommon) addService(service *Service) {
+	r.servicesMutex.Lock()
+	defer r.servicesMutex.Unlock()
+	r.Services = append(r.Services, service)
+}
+
+func (r *RouterCommon) removeService(service *Service) error {
+	r.updateMutex.Lock()
+	defer r.updateMutex.Unlock()
+	r.unregisterService(service)
+	return nil
+}
+
+// updateMutex must be hold
+func (r *RouterCommon) unregisterService(service *Service) {
+	r.servicesMutex.Lock()
+	defer r.servicesMutex.Unlock()
+
+	service.removed = true
+	for i, s := range r.Services {
+		if s == service {
+			r.Services = append(r.Services[:i], r.Services[i+1:]...)
+			break
+		}
+	}
+	delete(r.lastEvents, service.NameWithId())
+	logs.WithF(service.fields).Info("Service removed from router")
+}
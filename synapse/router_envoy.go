@@ -0,0 +1,180 @@
+package synapse
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discoveryv3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	serverv3 "github.com/envoyproxy/go-control-plane/pkg/server/v3"
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+	"github.com/n0rad/go-erlog/logs"
+	"google.golang.org/grpc"
+)
+
+// all envoy nodes receive the same resources
+const envoyNode = "synapse"
+
+// envoy control plane serving CDS, EDS and LDS with ADS over grpc
+type RouterEnvoy struct {
+	RouterCommon
+	ListenAddress         string
+	ConnectTimeoutInMilli int
+
+	cache     cachev3.SnapshotCache
+	mutex     sync.Mutex
+	version   int
+	resources envoyResources
+}
+
+type envoyNodeHash struct{}
+
+func (envoyNodeHash) ID(node *corev3.Node) string {
+	return envoyNode
+}
+
+type envoyLogger struct {
+	fields data.Fields
+}
+
+func (l envoyLogger) Debugf(format string, args ...interface{}) {
+	logs.WithF(l.fields).Trace(fmt.Sprintf(format, args...))
+}
+
+func (l envoyLogger) Infof(format string, args ...interface{}) {
+	logs.WithF(l.fields).Debug(fmt.Sprintf(format, args...))
+}
+
+func (l envoyLogger) Warnf(format string, args ...interface{}) {
+	logs.WithF(l.fields).Warn(fmt.Sprintf(format, args...))
+}
+
+func (l envoyLogger) Errorf(format string, args ...interface{}) {
+	logs.WithF(l.fields).Error(fmt.Sprintf(format, args...))
+}
+
+func NewRouterEnvoy() *RouterEnvoy {
+	return &RouterEnvoy{}
+}
+
+func (r *RouterEnvoy) Run(context *ContextImpl) {
+	// the discovery server is stopped before reporting the router done, a reloaded one binds the same address
+	context.doneWaiter.Add(1)
+	defer context.doneWaiter.Done()
+
+	listener, err := net.Listen("tcp", r.ListenAddress)
+	if err != nil {
+		r.synapse.routerUpdateFailures.WithLabelValues(r.Type + PrometheusLabelListenSuffix).Inc()
+		logs.WithEF(err, r.fields).Error("Failed to listen, envoy discovery is not served")
+	} else {
+		r.synapse.routerUpdateFailures.WithLabelValues(r.Type + PrometheusLabelListenSuffix).Set(0)
+		server := r.newGrpcServer()
+		go func() {
+			if err := server.Serve(listener); err != nil {
+				logs.WithEF(err, r.fields).Error("Envoy discovery server stopped")
+			}
+		}()
+		defer server.Stop()
+	}
+	r.RunCommon(context, r)
+}
+
+func (r *RouterEnvoy) Init(s *Synapse) error {
+	if err := r.commonInit(r, s); err != nil {
+		return errs.WithEF(err, r.fields, "Failed to init common router")
+	}
+	if err := checkEnvoyClusterNames(r.Services, r.fields); err != nil {
+		return err
+	}
+	if r.ListenAddress == "" {
+		r.ListenAddress = "127.0.0.1:18000"
+	}
+	if r.ConnectTimeoutInMilli == 0 {
+		r.ConnectTimeoutInMilli = 1000
+	}
+	r.fields = r.fields.WithField("listen", r.ListenAddress)
+	r.resources = make(envoyResources)
+	r.cache = cachev3.NewSnapshotCache(true, envoyNodeHash{}, envoyLogger{fields: r.fields})
+	r.synapse.routerUpdateFailures.WithLabelValues(r.Type).Set(0)
+	return nil
+}
+
+func (r *RouterEnvoy) newGrpcServer() *grpc.Server {
+	server := grpc.NewServer()
+	xds := serverv3.NewServer(context.Background(), r.cache, nil)
+	discoveryv3.RegisterAggregatedDiscoveryServiceServer(server, xds)
+	return server
+}
+
+func (r *RouterEnvoy) Update(reports []ServiceReport) error {
+	adsConfig := &corev3.ConfigSource{
+		ResourceApiVersion:    corev3.ApiVersion_V3,
+		ConfigSourceSpecifier: &corev3.ConfigSource_Ads{Ads: &corev3.AggregatedConfigSource{}},
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	failures := []error{}
+	for _, report := range reports {
+		resources := envoyServiceResourcesOf(report, r.ConnectTimeoutInMilli, adsConfig)
+		if err := r.resources.set(report.Service, resources); err != nil {
+			failures = append(failures, err)
+		}
+	}
+	if err := r.setSnapshot(); err != nil {
+		failures = append(failures, err)
+	}
+	if len(failures) > 0 {
+		return errs.WithF(r.fields, "Failed to update envoy resources").WithErrs(failures...)
+	}
+	return nil
+}
+
+func (r *RouterEnvoy) removeService(service *Service) error {
+	r.updateMutex.Lock()
+	defer r.updateMutex.Unlock()
+
+	r.unregisterService(service)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, ok := r.resources[service.NameWithId()]; !ok {
+		return nil
+	}
+	delete(r.resources, service.NameWithId())
+	if err := r.setSnapshot(); err != nil {
+		r.synapse.routerUpdateFailures.WithLabelValues(r.Type).Inc()
+		return err
+	}
+	return nil
+}
+
+func (r *RouterEnvoy) setSnapshot() error {
+	r.version++
+	snapshot, err := cachev3.NewSnapshot(strconv.Itoa(r.version), map[resource.Type][]types.Resource{
+		resource.ClusterType:  r.resources.ofType(resource.ClusterType),
+		resource.EndpointType: r.resources.ofType(resource.EndpointType),
+		resource.ListenerType: r.resources.ofType(resource.ListenerType),
+	})
+	if err != nil {
+		return errs.WithEF(err, r.fields, "Failed to prepare envoy snapshot")
+	}
+	if err := r.cache.SetSnapshot(context.Background(), envoyNode, snapshot); err != nil {
+		return errs.WithEF(err, r.fields, "Failed to set envoy snapshot")
+	}
+	return nil
+}
+
+func (r *RouterEnvoy) ParseServerOptions(data []byte) (interface{}, error) {
+	return nil, nil
+}
+
+func (r *RouterEnvoy) ParseRouterOptions(data []byte) (interface{}, error) {
+	return parseEnvoyRouterOptions(data, r.fields)
+}
@@ -0,0 +1,230 @@
+package synapse
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discoveryv3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/ghodss/yaml"
+	"github.com/n0rad/go-erlog/errs"
+	"github.com/n0rad/go-erlog/logs"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// envoy dynamic configuration from the filesystem (path_config_source), files are replaced atomically
+// so envoy's inotify watch sees complete files
+type RouterEnvoyFile struct {
+	RouterCommon
+	ConfigDirectory       string
+	Format                string
+	FileMode              os.FileMode
+	ConnectTimeoutInMilli int
+
+	resources envoyResources
+	written   map[string][]byte
+}
+
+func NewRouterEnvoyFile() *RouterEnvoyFile {
+	return &RouterEnvoyFile{}
+}
+
+func (r *RouterEnvoyFile) Run(context *ContextImpl) {
+	r.RunCommon(context, r)
+}
+
+func (r *RouterEnvoyFile) Init(s *Synapse) error {
+	if err := r.commonInit(r, s); err != nil {
+		return errs.WithEF(err, r.fields, "Failed to init common router")
+	}
+	if err := checkEnvoyClusterNames(r.Services, r.fields); err != nil {
+		return err
+	}
+	if r.ConfigDirectory == "" {
+		return errs.WithF(r.fields, "ConfigDirectory is mandatory")
+	}
+	configDirectory, err := filepath.Abs(r.ConfigDirectory)
+	if err != nil {
+		return errs.WithEF(err, r.fields, "Failed to get absolute path of configDirectory")
+	}
+	r.ConfigDirectory = configDirectory
+	r.fields = r.fields.WithField("directory", r.ConfigDirectory)
+	if r.Format == "" {
+		r.Format = "json"
+	}
+	if r.Format != "json" && r.Format != "yaml" {
+		return errs.WithF(r.fields.WithField("format", r.Format), "Unsupported format")
+	}
+	if r.FileMode == 0 {
+		r.FileMode = 0644
+	}
+	if r.ConnectTimeoutInMilli == 0 {
+		r.ConnectTimeoutInMilli = 1000
+	}
+	r.resources = make(envoyResources)
+	r.written = make(map[string][]byte)
+	r.synapse.routerUpdateFailures.WithLabelValues(r.Type).Set(0)
+	return nil
+}
+
+func (r *RouterEnvoyFile) Update(reports []ServiceReport) error {
+	failures := []error{}
+	for _, report := range reports {
+		resources := envoyServiceResourcesOf(report, r.ConnectTimeoutInMilli, &corev3.ConfigSource{
+			ResourceApiVersion:    corev3.ApiVersion_V3,
+			ConfigSourceSpecifier: &corev3.ConfigSource_PathConfigSource{PathConfigSource: &corev3.PathConfigSource{Path: r.endpointsPath(report.Service)}},
+		})
+		if err := r.resources.set(report.Service, resources); err != nil {
+			failures = append(failures, err)
+			continue
+		}
+
+		// endpoints first, so a new cluster finds its file
+		if err := r.writeResources(r.endpointsPath(report.Service), resource.EndpointType, []types.Resource{resources.endpoints}); err != nil {
+			failures = append(failures, err)
+		}
+	}
+	if err := r.writeClustersAndListeners(); err != nil {
+		failures = append(failures, err)
+	}
+	if len(failures) > 0 {
+		return errs.WithF(r.fields, "Failed to update envoy files").WithErrs(failures...)
+	}
+	return nil
+}
+
+func (r *RouterEnvoyFile) removeService(service *Service) error {
+	r.updateMutex.Lock()
+	defer r.updateMutex.Unlock()
+
+	r.unregisterService(service)
+	if _, ok := r.resources[service.NameWithId()]; !ok {
+		return nil
+	}
+	delete(r.resources, service.NameWithId())
+	if err := r.writeClustersAndListeners(); err != nil {
+		r.synapse.routerUpdateFailures.WithLabelValues(r.Type).Inc()
+		return errs.WithEF(err, r.fields.WithField("service", service.Name), "Failed to write envoy files after service removal")
+	}
+
+	path := r.endpointsPath(service)
+	delete(r.written, path)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		logs.WithEF(err, r.fields.WithField("file", path)).Warn("Failed to remove endpoints file")
+	}
+	return nil
+}
+
+func (r *RouterEnvoyFile) writeClustersAndListeners() error {
+	if err := r.writeResources(r.path("cds"), resource.ClusterType, r.resources.ofType(resource.ClusterType)); err != nil {
+		return err
+	}
+	return r.writeResources(r.path("lds"), resource.ListenerType, r.resources.ofType(resource.ListenerType))
+}
+
+func (r *RouterEnvoyFile) path(name string) string {
+	return filepath.Join(r.ConfigDirectory, name+"."+r.Format)
+}
+
+func (r *RouterEnvoyFile) endpointsPath(service *Service) string {
+	return r.path("eds_" + service.Name)
+}
+
+// a discovery response, as expected by envoy in path_config_source files
+func (r *RouterEnvoyFile) writeResources(path string, typeUrl string, resources []types.Resource) error {
+	fields := r.fields.WithField("file", path)
+	response := &discoveryv3.DiscoveryResponse{TypeUrl: typeUrl}
+	for _, res := range resources {
+		packed, err := anypb.New(res)
+		if err != nil {
+			return errs.WithEF(err, fields, "Failed to prepare envoy resources")
+		}
+		response.Resources = append(response.Resources, packed)
+	}
+	content, err := envoyMarshal(response)
+	if err != nil {
+		return errs.WithEF(err, fields, "Failed to prepare envoy resources")
+	}
+	response.VersionInfo = Sha1String(string(content))
+	if content, err = envoyMarshal(response); err != nil {
+		return errs.WithEF(err, fields, "Failed to prepare envoy discovery response")
+	}
+	if r.Format == "yaml" {
+		if content, err = yaml.JSONToYAML(content); err != nil {
+			return errs.WithEF(err, fields, "Failed to convert envoy resources to yaml")
+		}
+	}
+
+	if string(r.written[path]) == string(content) {
+		return nil
+	}
+	if err := os.MkdirAll(r.ConfigDirectory, 0755); err != nil {
+		return errs.WithEF(err, fields, "Cannot create directories")
+	}
+	if err := writeFileAtomically(path, content, r.FileMode); err != nil {
+		return errs.WithEF(err, fields, "Failed to write envoy resources")
+	}
+	r.written[path] = content
+	logs.WithF(fields).Debug("Envoy resources written")
+	return nil
+}
+
+// protojson output is compacted since its whitespace is not stable
+func envoyMarshal(response *discoveryv3.DiscoveryResponse) ([]byte, error) {
+	content, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(response)
+	if err != nil {
+		return nil, err
+	}
+	buff := bytes.Buffer{}
+	if err := json.Compact(&buff, content); err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
+
+// written in the same directory and renamed, so readers never see a partial file
+func writeFileAtomically(path string, content []byte, mode os.FileMode) error {
+	tmp, err := writeTempFile(path, content, mode)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// in the directory of path, so it can be renamed on it
+func writeTempFile(path string, content []byte, mode os.FileMode) (string, error) {
+	file, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return "", err
+	}
+
+	if _, err = file.Write(content); err == nil {
+		err = file.Chmod(mode)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+func (r *RouterEnvoyFile) ParseServerOptions(data []byte) (interface{}, error) {
+	return nil, nil
+}
+
+func (r *RouterEnvoyFile) ParseRouterOptions(data []byte) (interface{}, error) {
+	return parseEnvoyRouterOptions(data, r.fields)
+}
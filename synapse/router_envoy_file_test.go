@@ -0,0 +1,72 @@
+package synapse
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/blablacar/go-nerve/nerve"
+)
+
+func TestRouterEnvoyFileUpdate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "synapse-envoy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := &Synapse{}
+	s.Init("version", "buildtime", true)
+	r := NewRouterEnvoyFile()
+	r.ConfigDirectory = dir
+	if err := r.Init(s); err != nil {
+		t.Fatal(err)
+	}
+
+	yes := true
+	service := &Service{Name: "db"}
+	if err := r.Update([]ServiceReport{{Service: service, Reports: []Report{
+		{Report: nerve.Report{Name: "a", Host: "10.0.0.1", Port: 3306, Available: &yes}},
+	}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	cds := struct {
+		Resources []struct {
+			Name             string `json:"name"`
+			EdsClusterConfig struct {
+				EdsConfig struct {
+					PathConfigSource struct {
+						Path string `json:"path"`
+					} `json:"path_config_source"`
+				} `json:"eds_config"`
+			} `json:"eds_cluster_config"`
+		} `json:"resources"`
+	}{}
+	content, err := ioutil.ReadFile(filepath.Join(dir, "cds.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(content, &cds); err != nil {
+		t.Fatal(err)
+	}
+	if len(cds.Resources) != 1 || cds.Resources[0].Name != "db" {
+		t.Fatalf("unexpected clusters %s", content)
+	}
+	edsPath := cds.Resources[0].EdsClusterConfig.EdsConfig.PathConfigSource.Path
+	if edsPath != filepath.Join(dir, "eds_db.json") {
+		t.Errorf("unexpected endpoints path %s", edsPath)
+	}
+	if _, err := os.Stat(edsPath); err != nil {
+		t.Error(err)
+	}
+
+	if err := r.removeService(service); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(edsPath); !os.IsNotExist(err) {
+		t.Errorf("endpoints file should be removed, was %v", err)
+	}
+}
@@ -0,0 +1,145 @@
+package synapse
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/blablacar/go-nerve/nerve"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpointv3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	discoveryv3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func routerFailureCount(s *Synapse, label string) float64 {
+	metric := dto.Metric{}
+	s.routerUpdateFailures.WithLabelValues(label).Write(&metric)
+	return metric.GetGauge().GetValue()
+}
+
+func TestRouterEnvoyAds(t *testing.T) {
+	s := &Synapse{}
+	s.Init("version", "buildtime", true)
+
+	r := NewRouterEnvoy()
+	if err := r.Init(s); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := r.newGrpcServer()
+	go server.Serve(listener)
+	defer server.Stop()
+
+	yes := true
+	no := false
+	var weight uint8 = 42
+	if err := r.Update([]ServiceReport{{Service: &Service{Name: "db"}, Reports: []Report{
+		{Report: nerve.Report{Name: "a", Host: "10.0.0.1", Port: 3306, Available: &yes, Weight: &weight, Labels: map[string]string{"zone": "a"}}},
+		{Report: nerve.Report{Name: "b", Host: "10.0.0.2", Port: 3306, Available: &no}},
+	}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := grpc.NewClient(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := discoveryv3.NewAggregatedDiscoveryServiceClient(conn).StreamAggregatedResources(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Send(&discoveryv3.DiscoveryRequest{
+		Node:          &corev3.Node{Id: "envoy"},
+		TypeUrl:       resource.EndpointType,
+		ResourceNames: []string{"db"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	response, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.VersionInfo != "1" || len(response.Resources) != 1 {
+		t.Fatalf("unexpected response %v", response)
+	}
+
+	assignment := &endpointv3.ClusterLoadAssignment{}
+	if err := response.Resources[0].UnmarshalTo(assignment); err != nil {
+		t.Fatal(err)
+	}
+	endpoints := assignment.Endpoints[0].LbEndpoints
+	if assignment.ClusterName != "db" || len(endpoints) != 2 {
+		t.Fatalf("unexpected assignment %v", assignment)
+	}
+	if endpoints[0].HealthStatus != corev3.HealthStatus_HEALTHY || endpoints[0].LoadBalancingWeight.GetValue() != 42 ||
+		endpoints[0].Metadata.FilterMetadata["synapse"].Fields["zone"].GetStringValue() != "a" {
+		t.Errorf("unexpected available endpoint %v", endpoints[0])
+	}
+	if endpoints[1].HealthStatus != corev3.HealthStatus_UNHEALTHY {
+		t.Errorf("unexpected unavailable endpoint %v", endpoints[1])
+	}
+}
+
+func TestRouterEnvoyClusterNameCollision(t *testing.T) {
+	s := &Synapse{}
+	s.Init("version", "buildtime", true)
+
+	r := NewRouterEnvoy()
+	if err := r.Init(s); err != nil {
+		t.Fatal(err)
+	}
+	first := &Service{Name: "db", id: 1}
+	second := &Service{Name: "db", id: 2}
+	if err := r.Update([]ServiceReport{{Service: first}, {Service: second}}); err == nil {
+		t.Error("services with the same name should fail")
+	}
+	if len(r.resources) != 1 {
+		t.Errorf("first service should be kept, was %v", r.resources)
+	}
+
+	r = NewRouterEnvoy()
+	r.Services = []*Service{{Name: "db"}, {Name: "db"}}
+	if err := checkEnvoyClusterNames(r.Services, r.fields); err == nil {
+		t.Error("services with the same name should fail at init")
+	}
+}
+
+func TestRouterEnvoyListenFailure(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	s := &Synapse{}
+	s.Init("version", "buildtime", true)
+	r := NewRouterEnvoy()
+	r.ListenAddress = listener.Addr().String()
+	if err := r.Init(s); err != nil {
+		t.Fatal(err)
+	}
+	label := r.Type + PrometheusLabelListenSuffix
+	failures := routerFailureCount(s, label)
+
+	context := newContext(false)
+	go r.Run(context)
+	for i := 0; i < 50 && routerFailureCount(s, label) == failures; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(context.stop)
+	context.doneWaiter.Wait()
+	if routerFailureCount(s, label) != failures+1 {
+		t.Errorf("address already in use should be counted as listen failure")
+	}
+}
@@ -114,6 +114,23 @@ func (r *RouterHaProxy) Update(serviceReports []ServiceReport) error {
 	return nil
 }
 
+func (r *RouterHaProxy) removeService(service *Service) error {
+	r.updateMutex.Lock()
+	defer r.updateMutex.Unlock()
+
+	r.unregisterService(service)
+	if _, ok := r.Backend[service.NameWithId()]; !ok {
+		return nil
+	}
+	delete(r.Frontend, service.NameWithId())
+	delete(r.Backend, service.NameWithId())
+	if err := r.Reload(); err != nil {
+		r.synapse.routerUpdateFailures.WithLabelValues(r.Type).Inc()
+		return errs.WithEF(err, r.RouterCommon.fields.WithField("service", service.Name), "Failed to reload haproxy after service removal")
+	}
+	return nil
+}
+
 func (r *RouterHaProxy) toFrontendAndBackend(report ServiceReport) ([]string, []string, error) {
 	frontend := []string{}
 	if report.Service.typedRouterOptions != nil {
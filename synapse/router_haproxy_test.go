@@ -18,24 +18,24 @@ func TestIsSocketUpdatable(t *testing.T) {
 	no := false
 
 	NodeA := Report{
-		nerve.Report{
+		Report: nerve.Report{
 			Available:            &yes,
 			Host:                 "10.0.0.1",
 			Port:                 8080,
 			Name:                 "NodeA",
 			HaProxyServerOptions: "",
 		},
-		int64(0),
+		CreationTime: int64(0),
 	}
 	NodeB := Report{
-		nerve.Report{
+		Report: nerve.Report{
 			Available:            &no,
 			Host:                 "10.0.0.1",
 			Port:                 8080,
 			Name:                 "NodeB",
 			HaProxyServerOptions: "",
 		},
-		int64(0),
+		CreationTime: int64(0),
 	}
 
 	srNew := ServiceReport{
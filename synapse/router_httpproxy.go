@@ -0,0 +1,385 @@
+package synapse
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+	"github.com/n0rad/go-erlog/logs"
+)
+
+var errNoHttpServer = errs.With("No server available")
+
+// http reverse proxy on a single listener, requests are routed to services by host and path prefix
+type RouterHttpProxy struct {
+	RouterCommon
+	Bind string
+
+	upstreamsMutex sync.RWMutex
+	upstreams      map[string]*httpUpstream
+}
+
+type HttpProxyRouterOptions struct {
+	Hosts                 []string
+	PathPrefix            string
+	Balance               string
+	Retries               int
+	ConnectTimeoutInMilli int
+	TimeoutInMilli        int
+	MaxFails              int
+	EjectionInMilli       int
+}
+
+type httpUpstream struct {
+	HttpProxyRouterOptions
+	name      string
+	router    *RouterHttpProxy
+	pool      *serverPool
+	transport *http.Transport
+	proxy     *httputil.ReverseProxy
+	fields    data.Fields
+
+	failsMutex sync.Mutex
+	fails      map[string]*serverFails
+}
+
+type serverFails struct {
+	consecutive  int
+	ejectedUntil time.Time
+}
+
+// counts the request as active until its response body is closed
+type releaseOnClose struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (r *releaseOnClose) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(r.release)
+	return err
+}
+
+func NewRouterHttpProxy() *RouterHttpProxy {
+	return &RouterHttpProxy{}
+}
+
+func (r *RouterHttpProxy) Run(context *ContextImpl) {
+	// done only once the listener is closed, so a reloaded router can bind again
+	context.doneWaiter.Add(1)
+	defer context.doneWaiter.Done()
+
+	listener, err := net.Listen("tcp", r.Bind)
+	if err != nil {
+		r.synapse.routerUpdateFailures.WithLabelValues(r.Type + PrometheusLabelListenSuffix).Inc()
+		logs.WithEF(err, r.fields).Error("Failed to listen, http proxy is not served")
+	} else {
+		r.synapse.routerUpdateFailures.WithLabelValues(r.Type + PrometheusLabelListenSuffix).Set(0)
+		server := &http.Server{Handler: r}
+		go func() {
+			if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+				logs.WithEF(err, r.fields).Error("Http proxy stopped")
+			}
+		}()
+		defer server.Close()
+	}
+	r.RunCommon(context, r)
+}
+
+func (r *RouterHttpProxy) Init(s *Synapse) error {
+	if err := r.commonInit(r, s); err != nil {
+		return errs.WithEF(err, r.fields, "Failed to init common router")
+	}
+	if r.Bind == "" {
+		return errs.WithF(r.fields, "Bind is required for httpproxy router")
+	}
+	r.fields = r.fields.WithField("bind", r.Bind)
+	r.upstreams = make(map[string]*httpUpstream)
+	r.synapse.routerUpdateFailures.WithLabelValues(r.Type).Set(0)
+	return nil
+}
+
+func (r *RouterHttpProxy) Update(reports []ServiceReport) error {
+	r.upstreamsMutex.Lock()
+	defer r.upstreamsMutex.Unlock()
+
+	failures := []error{}
+	for _, report := range reports {
+		upstream, ok := r.upstreams[report.Service.NameWithId()]
+		if !ok {
+			var err error
+			if upstream, err = r.newHttpUpstream(report.Service); err != nil {
+				failures = append(failures, err)
+				continue
+			}
+			r.upstreams[report.Service.NameWithId()] = upstream
+		}
+		upstream.pool.update(report.Reports)
+		upstream.retainFails(report.Reports)
+	}
+	if len(failures) > 0 {
+		return errs.WithF(r.fields, "Failed to update some upstreams").WithErrs(failures...)
+	}
+	return nil
+}
+
+func (r *RouterHttpProxy) removeService(service *Service) error {
+	r.updateMutex.Lock()
+	defer r.updateMutex.Unlock()
+
+	r.unregisterService(service)
+	r.upstreamsMutex.Lock()
+	defer r.upstreamsMutex.Unlock()
+	if upstream, ok := r.upstreams[service.NameWithId()]; ok {
+		delete(r.upstreams, service.NameWithId())
+		upstream.transport.CloseIdleConnections()
+	}
+	return nil
+}
+
+func (r *RouterHttpProxy) newHttpUpstream(service *Service) (*httpUpstream, error) {
+	if service.typedRouterOptions == nil {
+		return nil, errs.WithF(r.fields.WithField("service", service.Name), "routerOptions with hosts or pathPrefix is required for httpproxy router")
+	}
+	upstream := &httpUpstream{
+		HttpProxyRouterOptions: service.typedRouterOptions.(HttpProxyRouterOptions),
+		name:                   service.Name,
+		router:                 r,
+		fields:                 r.fields.WithField("service", service.Name),
+		fails:                  make(map[string]*serverFails),
+	}
+	if upstream.ConnectTimeoutInMilli == 0 {
+		upstream.ConnectTimeoutInMilli = 1000
+	}
+	if upstream.TimeoutInMilli == 0 {
+		upstream.TimeoutInMilli = 30000
+	}
+	if upstream.MaxFails == 0 {
+		upstream.MaxFails = 5
+	}
+	if upstream.EjectionInMilli == 0 {
+		upstream.EjectionInMilli = 30000
+	}
+
+	var err error
+	if upstream.pool, err = newServerPool(upstream.Balance, 0, upstream.fields); err != nil {
+		return nil, err
+	}
+	upstream.transport = &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   time.Duration(upstream.ConnectTimeoutInMilli) * time.Millisecond,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ResponseHeaderTimeout: time.Duration(upstream.TimeoutInMilli) * time.Millisecond,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConnsPerHost:   16,
+	}
+	upstream.proxy = &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = "http"
+			req.URL.Host = service.Name // replaced by the server in RoundTrip
+		},
+		Transport: upstream,
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			if err == errNoHttpServer {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			logs.WithEF(err, upstream.fields.WithField("url", req.URL.String())).Warn("Proxy request failed")
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+	return upstream, nil
+}
+
+func (r *RouterHttpProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	upstream := r.route(req)
+	if upstream == nil {
+		http.NotFound(w, req)
+		return
+	}
+	upstream.proxy.ServeHTTP(w, req)
+}
+
+// most specific upstream: with a matching host first, then with the longest path prefix
+func (r *RouterHttpProxy) route(req *http.Request) *httpUpstream {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	r.upstreamsMutex.RLock()
+	defer r.upstreamsMutex.RUnlock()
+	names := []string{}
+	for name := range r.upstreams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var best *httpUpstream
+	for _, name := range names {
+		upstream := r.upstreams[name]
+		hostMatch, ok := upstream.matches(host, req.URL.Path)
+		if !ok {
+			continue
+		}
+		if best == nil {
+			best = upstream
+			continue
+		}
+		bestHostMatch := len(best.Hosts) > 0
+		if (hostMatch && !bestHostMatch) || (hostMatch == bestHostMatch && len(upstream.PathPrefix) > len(best.PathPrefix)) {
+			best = upstream
+		}
+	}
+	return best
+}
+
+func (u *httpUpstream) matches(host string, path string) (bool, bool) {
+	if !strings.HasPrefix(path, u.PathPrefix) {
+		return false, false
+	}
+	if len(u.Hosts) == 0 {
+		return false, true
+	}
+	for _, h := range u.Hosts {
+		if strings.EqualFold(h, host) {
+			return true, true
+		}
+	}
+	return false, false
+}
+
+// failed requests are retried on other servers when they have no body to replay.
+// when all servers are ejected, they are used anyway
+func (u *httpUpstream) RoundTrip(req *http.Request) (*http.Response, error) {
+	retryable := req.Body == nil || req.Body == http.NoBody
+	tried := make(map[*poolServer]struct{})
+	var lastResp *http.Response
+	var lastErr error
+	for attempt := 0; attempt <= u.Retries; attempt++ {
+		now := time.Now()
+		server := u.pool.pick(func(server *poolServer) bool {
+			_, ok := tried[server]
+			return ok || u.isEjected(server.name, now)
+		})
+		if server == nil && attempt == 0 {
+			server = u.pool.pick(nil)
+		}
+		if server == nil {
+			break
+		}
+		tried[server] = struct{}{}
+		if lastResp != nil {
+			lastResp.Body.Close()
+		}
+
+		lastResp, lastErr = u.roundTripTo(server, req)
+		failed := lastErr != nil || lastResp.StatusCode >= 500
+		u.passiveCheck(server.name, failed, now)
+		if !failed || !retryable {
+			break
+		}
+	}
+
+	if lastResp == nil && lastErr == nil {
+		lastErr = errNoHttpServer
+	}
+	return lastResp, lastErr
+}
+
+func (u *httpUpstream) roundTripTo(server *poolServer, req *http.Request) (*http.Response, error) {
+	outReq := new(http.Request)
+	*outReq = *req
+	url := *req.URL
+	url.Host = server.address
+	outReq.URL = &url
+
+	start := time.Now()
+	u.pool.acquire(server, nil)
+	resp, err := u.transport.RoundTrip(outReq)
+	u.router.synapse.httpProxyDuration.WithLabelValues(u.name, server.name).Observe(time.Since(start).Seconds())
+	if err != nil {
+		u.pool.release(server, nil)
+		u.router.synapse.httpProxyRequests.WithLabelValues(u.name, server.name, "error").Inc()
+		return nil, err
+	}
+	u.router.synapse.httpProxyRequests.WithLabelValues(u.name, server.name, strconv.Itoa(resp.StatusCode)).Inc()
+	resp.Body = &releaseOnClose{ReadCloser: resp.Body, release: func() { u.pool.release(server, nil) }}
+	return resp, nil
+}
+
+// a server failing maxFails times in a row is ejected for ejectionInMilli
+func (u *httpUpstream) passiveCheck(name string, failed bool, now time.Time) {
+	u.failsMutex.Lock()
+	defer u.failsMutex.Unlock()
+
+	fails, ok := u.fails[name]
+	if !ok {
+		fails = &serverFails{}
+		u.fails[name] = fails
+	}
+	if !failed {
+		fails.consecutive = 0
+		return
+	}
+	fails.consecutive++
+	if fails.consecutive >= u.MaxFails {
+		fails.consecutive = 0
+		fails.ejectedUntil = now.Add(time.Duration(u.EjectionInMilli) * time.Millisecond)
+		logs.WithF(u.fields.WithField("server", name).WithField("until", fails.ejectedUntil)).Warn("Server is failing. Ejecting it")
+	}
+}
+
+func (u *httpUpstream) isEjected(name string, now time.Time) bool {
+	u.failsMutex.Lock()
+	defer u.failsMutex.Unlock()
+	fails, ok := u.fails[name]
+	return ok && now.Before(fails.ejectedUntil)
+}
+
+func (u *httpUpstream) retainFails(reports []Report) {
+	u.failsMutex.Lock()
+	defer u.failsMutex.Unlock()
+	names := make(map[string]struct{}, len(reports))
+	for _, report := range reports {
+		names[report.Name] = struct{}{}
+	}
+	for name := range u.fails {
+		if _, ok := names[name]; !ok {
+			delete(u.fails, name)
+		}
+	}
+}
+
+func (r *RouterHttpProxy) ParseServerOptions(data []byte) (interface{}, error) {
+	return nil, nil
+}
+
+func (r *RouterHttpProxy) ParseRouterOptions(data []byte) (interface{}, error) {
+	routerOptions := HttpProxyRouterOptions{}
+	fields := r.fields.WithField("content", string(data))
+	if err := json.Unmarshal(data, &routerOptions); err != nil {
+		return nil, errs.WithEF(err, fields, "Failed to Unmarshal routerOptions")
+	}
+	if len(routerOptions.Hosts) == 0 && routerOptions.PathPrefix == "" {
+		return nil, errs.WithF(fields, "hosts or pathPrefix is required in routerOptions")
+	}
+	if routerOptions.Retries < 0 {
+		return nil, errs.WithF(fields, "retries must be positive")
+	}
+	if _, err := newServerPool(routerOptions.Balance, 0, fields); err != nil {
+		return nil, err
+	}
+	return routerOptions, nil
+}
@@ -0,0 +1,104 @@
+package synapse
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/blablacar/go-nerve/nerve"
+)
+
+func httpProxyTestServer(name string, code int) (*httptest.Server, Report) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(code)
+		w.Write([]byte(name))
+	}))
+	addr := server.Listener.Addr().(*net.TCPAddr)
+	available := true
+	return server, Report{Report: nerve.Report{Name: name, Host: "127.0.0.1", Port: nerve.Port(addr.Port), Available: &available}}
+}
+
+func TestRouterHttpProxy(t *testing.T) {
+	s := &Synapse{}
+	s.Init("version", "buildtime", true)
+	r := NewRouterHttpProxy()
+	r.Bind = "127.0.0.1:0"
+	if err := r.Init(s); err != nil {
+		t.Fatal(err)
+	}
+
+	failing, failingReport := httpProxyTestServer("failing", http.StatusInternalServerError)
+	defer failing.Close()
+	api, apiReport := httpProxyTestServer("api", http.StatusOK)
+	defer api.Close()
+	web, webReport := httpProxyTestServer("web", http.StatusOK)
+	defer web.Close()
+
+	apiService := &Service{Name: "api", typedRouterOptions: HttpProxyRouterOptions{PathPrefix: "/api", Retries: 1, MaxFails: 1}}
+	webService := &Service{Name: "web", typedRouterOptions: HttpProxyRouterOptions{PathPrefix: "/"}}
+	hostService := &Service{Name: "host", typedRouterOptions: HttpProxyRouterOptions{Hosts: []string{"host.local"}}}
+	invalidService := &Service{Name: "invalid"}
+	if err := r.Update([]ServiceReport{
+		{Service: invalidService},
+		{Service: apiService, Reports: []Report{failingReport, apiReport}},
+		{Service: webService, Reports: []Report{webReport}},
+		{Service: hostService},
+	}); err == nil {
+		t.Fatal("service without routerOptions should fail")
+	}
+	if len(r.upstreams) != 3 {
+		t.Fatalf("valid services should be updated, was %v", r.upstreams)
+	}
+
+	for _, test := range []struct {
+		url  string
+		code int
+		body string
+	}{
+		{"http://synapse.local/api/users", http.StatusOK, "api"},
+		{"http://synapse.local/api/users", http.StatusOK, "api"},
+		{"http://synapse.local/index.html", http.StatusOK, "web"},
+		{"http://host.local:8080/api", http.StatusServiceUnavailable, ""},
+	} {
+		recorder := httptest.NewRecorder()
+		r.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, test.url, nil))
+		if recorder.Code != test.code || recorder.Body.String() != test.body {
+			t.Errorf("%s should answer %d '%s', was %d '%s'", test.url, test.code, test.body, recorder.Code, recorder.Body.String())
+		}
+	}
+
+	if !r.upstreams[apiService.NameWithId()].isEjected("failing", time.Now()) {
+		t.Error("failing server should be ejected")
+	}
+}
+
+func TestRouterHttpProxyListenFailure(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	s := &Synapse{}
+	s.Init("version", "buildtime", true)
+	r := NewRouterHttpProxy()
+	r.Bind = listener.Addr().String()
+	if err := r.Init(s); err != nil {
+		t.Fatal(err)
+	}
+	label := r.Type + PrometheusLabelListenSuffix
+	failures := routerFailureCount(s, label)
+
+	context := newContext(false)
+	go r.Run(context)
+	for i := 0; i < 50 && routerFailureCount(s, label) == failures; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(context.stop)
+	context.doneWaiter.Wait()
+	if routerFailureCount(s, label) != failures+1 {
+		t.Errorf("address already in use should be counted as listen failure")
+	}
+}
@@ -0,0 +1,266 @@
+package synapse
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"text/template"
+	"time"
+
+	"github.com/blablacar/go-nerve/nerve"
+	"github.com/n0rad/go-erlog/errs"
+	"github.com/n0rad/go-erlog/logs"
+)
+
+const nginxConfigurationTemplate = `# Handled by synapse. Do not modify it.
+{{- range .}}
+
+upstream {{.Name}} {
+{{- range .Upstream}}
+  {{.}}{{end}}
+{{- range .Servers}}
+  {{.}}{{end}}
+}
+{{- if .Server}}
+
+server {
+{{- range .Server}}
+  {{.}}{{end}}
+{{- range $path, $location := .Locations}}
+
+  location {{$path}} {
+{{- range $location}}
+    {{.}}{{end}}
+  }
+{{- end}}
+}
+{{- end}}
+{{- end}}
+`
+
+// nginx upstreams, the configuration file is meant to be included in an http or stream block
+type RouterNginx struct {
+	RouterCommon
+	ConfigPath               string
+	TestCommand              []string
+	TestTimeoutInMilli       int
+	ReloadCommand            []string
+	ReloadTimeoutInMilli     int
+	ReloadMinIntervalInMilli int
+	BackupLabel              string
+
+	template   *template.Template
+	upstreams  map[string]nginxUpstream
+	lastReload time.Time
+}
+
+type NginxRouterOptions struct {
+	Upstream  []string
+	Server    []string
+	Locations map[string][]string
+}
+
+type nginxUpstream struct {
+	NginxRouterOptions
+	Name    string
+	Servers []string
+}
+
+func NewRouterNginx() *RouterNginx {
+	return &RouterNginx{}
+}
+
+func (r *RouterNginx) Run(context *ContextImpl) {
+	r.RunCommon(context, r)
+}
+
+func (r *RouterNginx) Init(s *Synapse) error {
+	if err := r.commonInit(r, s); err != nil {
+		return errs.WithEF(err, r.fields, "Failed to init common router")
+	}
+	if r.ConfigPath == "" {
+		return errs.WithF(r.fields, "ConfigPath is required for nginx router")
+	}
+	r.fields = r.fields.WithField("config", r.ConfigPath)
+	if len(r.ReloadCommand) == 0 {
+		return errs.WithF(r.fields, "ReloadCommand is required for nginx router")
+	}
+	if r.TestTimeoutInMilli == 0 {
+		r.TestTimeoutInMilli = 5000
+	}
+	if r.ReloadTimeoutInMilli == 0 {
+		r.ReloadTimeoutInMilli = 1000
+	}
+	if r.ReloadMinIntervalInMilli == 0 {
+		r.ReloadMinIntervalInMilli = 500
+	}
+	if r.BackupLabel == "" {
+		r.BackupLabel = "backup"
+	}
+	r.upstreams = make(map[string]nginxUpstream)
+	r.synapse.routerUpdateFailures.WithLabelValues(r.Type).Set(0)
+
+	tmpl, err := template.New("nginx-config").Parse(nginxConfigurationTemplate)
+	if err != nil {
+		return errs.WithEF(err, r.fields, "Failed to parse nginx config template")
+	}
+	r.template = tmpl
+	return nil
+}
+
+func (r *RouterNginx) Update(reports []ServiceReport) error {
+	upstreams := make(map[string]nginxUpstream, len(r.upstreams))
+	for name, upstream := range r.upstreams {
+		upstreams[name] = upstream
+	}
+	for _, report := range reports {
+		upstreams[report.Service.NameWithId()] = r.toUpstream(report)
+	}
+
+	if err := r.apply(upstreams); err != nil {
+		return errs.WithEF(err, r.fields, "Failed to update nginx")
+	}
+	return nil
+}
+
+func (r *RouterNginx) removeService(service *Service) error {
+	r.updateMutex.Lock()
+	defer r.updateMutex.Unlock()
+
+	r.unregisterService(service)
+	if _, ok := r.upstreams[service.NameWithId()]; !ok {
+		return nil
+	}
+	upstreams := make(map[string]nginxUpstream, len(r.upstreams))
+	for name, upstream := range r.upstreams {
+		if name != service.NameWithId() {
+			upstreams[name] = upstream
+		}
+	}
+	if err := r.apply(upstreams); err != nil {
+		r.synapse.routerUpdateFailures.WithLabelValues(r.Type).Inc()
+		return errs.WithEF(err, r.fields.WithField("service", service.Name), "Failed to update nginx after service removal")
+	}
+	return nil
+}
+
+// the test command sees the new file through the includes of the main nginx configuration,
+// the previous one is restored when the test fails
+func (r *RouterNginx) apply(upstreams map[string]nginxUpstream) error {
+	content, err := r.render(upstreams)
+	if err != nil {
+		return err
+	}
+	previous, err := ioutil.ReadFile(r.ConfigPath)
+	if err != nil && !os.IsNotExist(err) {
+		return errs.WithEF(err, r.fields, "Failed to read current configuration file")
+	}
+	if err := writeFileAtomically(r.ConfigPath, content, 0644); err != nil {
+		return errs.WithEF(err, r.fields, "Failed to write configuration file")
+	}
+
+	env := append(os.Environ(), "NGINX_CONFIG="+r.ConfigPath)
+	if len(r.TestCommand) > 0 {
+		if err := nerve.ExecCommandFull(r.TestCommand, env, r.TestTimeoutInMilli); err != nil {
+			r.restore(previous)
+			return errs.WithEF(err, r.fields, "Configuration test failed")
+		}
+	}
+
+	waitDuration := r.lastReload.Add(time.Duration(r.ReloadMinIntervalInMilli) * time.Millisecond).Sub(time.Now())
+	if waitDuration > 0 {
+		logs.WithF(r.fields.WithField("wait", waitDuration)).Debug("Reloading too fast")
+		time.Sleep(waitDuration)
+	}
+	defer func() {
+		r.lastReload = time.Now()
+	}()
+	r.upstreams = upstreams
+	logs.WithF(r.fields).Info("Reloading nginx")
+	if err := nerve.ExecCommandFull(r.ReloadCommand, env, r.ReloadTimeoutInMilli); err != nil {
+		return errs.WithEF(err, r.fields, "Failed to reload nginx")
+	}
+	return nil
+}
+
+// no previous content means there was no file
+func (r *RouterNginx) restore(previous []byte) {
+	var err error
+	if previous == nil {
+		err = os.Remove(r.ConfigPath)
+	} else {
+		err = writeFileAtomically(r.ConfigPath, previous, 0644)
+	}
+	if err != nil {
+		logs.WithEF(err, r.fields).Error("Failed to restore previous configuration file")
+	}
+}
+
+func (r *RouterNginx) render(upstreams map[string]nginxUpstream) ([]byte, error) {
+	names := []string{}
+	for name := range upstreams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	sorted := []nginxUpstream{}
+	for _, name := range names {
+		sorted = append(sorted, upstreams[name])
+	}
+
+	var buff bytes.Buffer
+	if err := r.template.Execute(&buff, sorted); err != nil {
+		return nil, errs.WithEF(err, r.fields, "Failed to template nginx configuration file")
+	}
+	if logs.IsTraceEnabled() {
+		logs.WithF(r.fields.WithField("templated", buff.String())).Trace("Templated configuration file")
+	}
+	return buff.Bytes(), nil
+}
+
+func (r *RouterNginx) toUpstream(report ServiceReport) nginxUpstream {
+	upstream := nginxUpstream{Name: report.Service.Name}
+	if report.Service.typedRouterOptions != nil {
+		upstream.NginxRouterOptions = report.Service.typedRouterOptions.(NginxRouterOptions)
+	}
+	for _, server := range report.Reports {
+		upstream.Servers = append(upstream.Servers, r.toServer(server))
+	}
+	if len(upstream.Servers) == 0 {
+		// nginx refuses an upstream without server
+		upstream.Servers = []string{"server 127.0.0.1:1 down;"}
+	}
+	return upstream
+}
+
+func (r *RouterNginx) toServer(report Report) string {
+	server := fmt.Sprintf("server %s:%d", report.Host, report.Port)
+	if report.Weight != nil && *report.Weight > 0 {
+		server += fmt.Sprintf(" weight=%d", *report.Weight)
+	}
+	if report.Labels[r.BackupLabel] == "true" {
+		server += " backup"
+	}
+	// nerve weight 0 means the server is draining
+	if (report.Available != nil && !*report.Available) || (report.Weight != nil && *report.Weight == 0) {
+		server += " down"
+	}
+	return server + ";"
+}
+
+func (r *RouterNginx) ParseServerOptions(data []byte) (interface{}, error) {
+	return nil, nil
+}
+
+func (r *RouterNginx) ParseRouterOptions(data []byte) (interface{}, error) {
+	routerOptions := NginxRouterOptions{}
+	if err := json.Unmarshal(data, &routerOptions); err != nil {
+		return nil, errs.WithEF(err, r.fields.WithField("content", string(data)), "Failed to Unmarshal routerOptions")
+	}
+	if len(routerOptions.Locations) > 0 && len(routerOptions.Server) == 0 {
+		return nil, errs.WithF(r.fields, "Locations need a server")
+	}
+	return routerOptions, nil
+}
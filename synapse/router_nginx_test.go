@@ -0,0 +1,121 @@
+package synapse
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/blablacar/go-nerve/nerve"
+)
+
+func TestRouterNginxUpdate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "synapse-nginx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := &Synapse{}
+	s.Init("version", "buildtime", true)
+	r := NewRouterNginx()
+	r.ConfigPath = filepath.Join(dir, "synapse.conf")
+	r.TestCommand = []string{"/bin/sh", "-c", "! grep -q broken $NGINX_CONFIG"}
+	r.ReloadCommand = []string{"/bin/true"}
+	r.ReloadMinIntervalInMilli = 1
+	if err := r.Init(s); err != nil {
+		t.Fatal(err)
+	}
+
+	yes := true
+	no := false
+	var weight uint8 = 42
+	service := &Service{Name: "web", typedRouterOptions: NginxRouterOptions{
+		Upstream:  []string{"least_conn;"},
+		Server:    []string{"listen 127.0.0.1:8080;"},
+		Locations: map[string][]string{"/": {"proxy_pass http://web;"}},
+	}}
+	if err := r.Update([]ServiceReport{{Service: service, Reports: []Report{
+		{Report: nerve.Report{Name: "a", Host: "10.0.0.1", Port: 80, Available: &yes, Weight: &weight}},
+		{Report: nerve.Report{Name: "b", Host: "10.0.0.2", Port: 80, Available: &no}},
+		{Report: nerve.Report{Name: "c", Host: "10.0.0.3", Port: 80, Available: &yes, Labels: map[string]string{"backup": "true"}}},
+	}}}); err != nil {
+		t.Fatal(err)
+	}
+	content, _ := ioutil.ReadFile(r.ConfigPath)
+	for _, expected := range []string{"upstream web {", "least_conn;", "server 10.0.0.1:80 weight=42;", "server 10.0.0.2:80 down;",
+		"server 10.0.0.3:80 backup;", "listen 127.0.0.1:8080;", "location / {", "proxy_pass http://web;"} {
+		if !strings.Contains(string(content), expected) {
+			t.Errorf("configuration should contain '%s', was:\n%s", expected, content)
+		}
+	}
+
+	broken := &Service{Name: "broken"}
+	if err := r.Update([]ServiceReport{{Service: broken}}); err == nil {
+		t.Error("update should fail when test command fails")
+	}
+	if current, _ := ioutil.ReadFile(r.ConfigPath); string(current) != string(content) {
+		t.Errorf("previous configuration should be restored, was:\n%s", current)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("only the configuration file should be left, found %d files", len(files))
+	}
+}
+
+// the fragment is checked by nginx itself, included in a main configuration like in production
+func TestRouterNginxFragment(t *testing.T) {
+	nginx, err := exec.LookPath("nginx")
+	if err != nil {
+		t.Skip("nginx is not installed")
+	}
+	dir, err := ioutil.TempDir("", "synapse-nginx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "logs"), 0755)
+	mainConfig := filepath.Join(dir, "nginx.conf")
+	ioutil.WriteFile(mainConfig, []byte(`pid `+filepath.Join(dir, "nginx.pid")+`;
+error_log `+filepath.Join(dir, "error.log")+`;
+events {}
+http {
+  access_log off;
+  include `+filepath.Join(dir, "synapse.conf")+`;
+}
+`), 0644)
+
+	s := &Synapse{}
+	s.Init("version", "buildtime", true)
+	r := NewRouterNginx()
+	r.ConfigPath = filepath.Join(dir, "synapse.conf")
+	r.TestCommand = []string{nginx, "-t", "-q", "-p", dir, "-c", mainConfig}
+	r.ReloadCommand = []string{"/bin/true"}
+	r.ReloadMinIntervalInMilli = 1
+	if err := r.Init(s); err != nil {
+		t.Fatal(err)
+	}
+
+	available := true
+	service := &Service{Name: "web", typedRouterOptions: NginxRouterOptions{
+		Upstream:  []string{"least_conn;"},
+		Server:    []string{"listen 127.0.0.1:" + strconv.Itoa(freeTestPort(t)) + ";"},
+		Locations: map[string][]string{"/": {"proxy_pass http://web;"}},
+	}}
+	if err := r.Update([]ServiceReport{{Service: service, Reports: []Report{
+		{Report: nerve.Report{Name: "a", Host: "127.0.0.1", Port: 8080, Available: &available}},
+	}}}); err != nil {
+		t.Fatalf("valid fragment should pass nginx test, was %v", err)
+	}
+	content, _ := ioutil.ReadFile(r.ConfigPath)
+
+	invalid := &Service{Name: "invalid", typedRouterOptions: NginxRouterOptions{Upstream: []string{"not_a_directive;"}}}
+	if err := r.Update([]ServiceReport{{Service: invalid}}); err == nil {
+		t.Error("invalid fragment should fail nginx test")
+	}
+	if current, _ := ioutil.ReadFile(r.ConfigPath); string(current) != string(content) {
+		t.Errorf("previous configuration should be restored, was:\n%s", current)
+	}
+}
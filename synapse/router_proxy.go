@@ -0,0 +1,221 @@
+package synapse
+
+import (
+	"encoding/json"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+	"github.com/n0rad/go-erlog/logs"
+)
+
+// synapse itself forwards tcp connections of each service to its available servers
+type RouterProxy struct {
+	RouterCommon
+	ConnectTimeoutInMilli int
+	ConnectAttempts       int
+	DrainTimeoutInMilli   int
+
+	proxiesMutex sync.Mutex
+	proxies      map[string]*tcpProxy
+}
+
+type ProxyRouterOptions struct {
+	Bind    string
+	Balance string
+}
+
+type tcpProxy struct {
+	router   *RouterProxy
+	pool     *serverPool
+	listener net.Listener
+	fields   data.Fields
+
+	closedMutex sync.Mutex
+	closed      bool
+}
+
+func NewRouterProxy() *RouterProxy {
+	return &RouterProxy{}
+}
+
+func (r *RouterProxy) Run(context *ContextImpl) {
+	// binds are released before reporting the router done, for reloads
+	context.doneWaiter.Add(1)
+	defer context.doneWaiter.Done()
+
+	r.RunCommon(context, r)
+
+	r.proxiesMutex.Lock()
+	defer r.proxiesMutex.Unlock()
+	for name, proxy := range r.proxies {
+		proxy.close()
+		delete(r.proxies, name)
+	}
+}
+
+func (r *RouterProxy) Init(s *Synapse) error {
+	if err := r.commonInit(r, s); err != nil {
+		return errs.WithEF(err, r.fields, "Failed to init common router")
+	}
+	if r.ConnectTimeoutInMilli == 0 {
+		r.ConnectTimeoutInMilli = 1000
+	}
+	if r.ConnectAttempts == 0 {
+		r.ConnectAttempts = 3
+	}
+	if r.DrainTimeoutInMilli == 0 {
+		r.DrainTimeoutInMilli = 30000
+	}
+	r.proxies = make(map[string]*tcpProxy)
+	r.synapse.routerUpdateFailures.WithLabelValues(r.Type).Set(0)
+	return nil
+}
+
+func (r *RouterProxy) Update(reports []ServiceReport) error {
+	r.proxiesMutex.Lock()
+	defer r.proxiesMutex.Unlock()
+
+	failures := []error{}
+	for _, report := range reports {
+		proxy, ok := r.proxies[report.Service.NameWithId()]
+		if !ok {
+			var err error
+			if proxy, err = r.newTcpProxy(report.Service); err != nil {
+				failures = append(failures, err)
+				continue
+			}
+			r.proxies[report.Service.NameWithId()] = proxy
+		}
+		proxy.pool.update(report.Reports)
+	}
+	if len(failures) > 0 {
+		return errs.WithF(r.fields, "Failed to update some proxies").WithErrs(failures...)
+	}
+	return nil
+}
+
+func (r *RouterProxy) removeService(service *Service) error {
+	r.updateMutex.Lock()
+	defer r.updateMutex.Unlock()
+
+	r.unregisterService(service)
+	r.proxiesMutex.Lock()
+	defer r.proxiesMutex.Unlock()
+	if proxy, ok := r.proxies[service.NameWithId()]; ok {
+		proxy.close()
+		delete(r.proxies, service.NameWithId())
+	}
+	return nil
+}
+
+func (r *RouterProxy) newTcpProxy(service *Service) (*tcpProxy, error) {
+	if service.typedRouterOptions == nil {
+		return nil, errs.WithF(r.fields.WithField("service", service.Name), "routerOptions with bind is required for proxy router")
+	}
+	options := service.typedRouterOptions.(ProxyRouterOptions)
+	fields := r.fields.WithField("service", service.Name).WithField("bind", options.Bind)
+	pool, err := newServerPool(options.Balance, time.Duration(r.DrainTimeoutInMilli)*time.Millisecond, fields)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", options.Bind)
+	if err != nil {
+		return nil, errs.WithEF(err, fields, "Failed to listen")
+	}
+	logs.WithF(fields).Info("Proxy listening")
+
+	proxy := &tcpProxy{router: r, pool: pool, listener: listener, fields: fields}
+	go proxy.serve()
+	return proxy, nil
+}
+
+func (p *tcpProxy) close() {
+	p.closedMutex.Lock()
+	p.closed = true
+	p.closedMutex.Unlock()
+	if err := p.listener.Close(); err != nil {
+		logs.WithEF(err, p.fields).Warn("Failed to close listener")
+	}
+	p.pool.drainAll()
+}
+
+func (p *tcpProxy) isClosed() bool {
+	p.closedMutex.Lock()
+	defer p.closedMutex.Unlock()
+	return p.closed
+}
+
+func (p *tcpProxy) serve() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			if p.isClosed() {
+				return
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				logs.WithEF(err, p.fields).Warn("Failed to accept connection")
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			logs.WithEF(err, p.fields).Error("Proxy stopped accepting connections")
+			return
+		}
+		go p.handle(conn)
+	}
+}
+
+// on connect failure, other servers are tried up to connectAttempts
+func (p *tcpProxy) handle(client net.Conn) {
+	timeout := time.Duration(p.router.ConnectTimeoutInMilli) * time.Millisecond
+	tried := make(map[*poolServer]struct{})
+	for attempt := 0; attempt < p.router.ConnectAttempts; attempt++ {
+		server := p.pool.pick(func(server *poolServer) bool {
+			_, ok := tried[server]
+			return ok
+		})
+		if server == nil {
+			break
+		}
+		tried[server] = struct{}{}
+
+		upstream, err := net.DialTimeout("tcp", server.address, timeout)
+		if err != nil {
+			logs.WithEF(err, p.fields.WithField("server", server.name)).Warn("Failed to connect to server")
+			continue
+		}
+
+		conn := &proxyConnection{client: client, upstream: upstream}
+		if !p.pool.acquire(server, conn) {
+			upstream.Close()
+			continue
+		}
+		conn.pipe()
+		p.pool.release(server, conn)
+		return
+	}
+
+	logs.WithF(p.fields.WithField("client", client.RemoteAddr())).Warn("No server available for connection")
+	client.Close()
+}
+
+func (r *RouterProxy) ParseServerOptions(data []byte) (interface{}, error) {
+	return nil, nil
+}
+
+func (r *RouterProxy) ParseRouterOptions(data []byte) (interface{}, error) {
+	routerOptions := ProxyRouterOptions{}
+	fields := r.fields.WithField("content", string(data))
+	if err := json.Unmarshal(data, &routerOptions); err != nil {
+		return nil, errs.WithEF(err, fields, "Failed to Unmarshal routerOptions")
+	}
+	if routerOptions.Bind == "" {
+		return nil, errs.WithF(fields, "bind is required in routerOptions")
+	}
+	if _, err := newServerPool(routerOptions.Balance, 0, fields); err != nil {
+		return nil, err
+	}
+	return routerOptions, nil
+}
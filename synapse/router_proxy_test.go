@@ -0,0 +1,93 @@
+package synapse
+
+import (
+	"bufio"
+	"net"
+	"testing"
+
+	"github.com/blablacar/go-nerve/nerve"
+)
+
+// answers its name to each connection
+func proxyTestServer(t *testing.T, name string) (net.Listener, Report) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte(name + "\n"))
+			conn.Close()
+		}
+	}()
+	available := true
+	port := nerve.Port(listener.Addr().(*net.TCPAddr).Port)
+	return listener, Report{Report: nerve.Report{Name: name, Host: "127.0.0.1", Port: port, Available: &available}}
+}
+
+func TestServerPoolBalance(t *testing.T) {
+	var heavy uint8 = 200
+	var light uint8 = 100
+	pool, _ := newServerPool(PROXY_BALANCE_WEIGHTED, 0, nil)
+	pool.update([]Report{
+		{Report: nerve.Report{Name: "heavy", Weight: &heavy}},
+		{Report: nerve.Report{Name: "light", Weight: &light}},
+	})
+	picked := map[string]int{}
+	for i := 0; i < 30; i++ {
+		picked[pool.pick(nil).name]++
+	}
+	if picked["heavy"] != 20 || picked["light"] != 10 {
+		t.Errorf("unexpected weighted balance %v", picked)
+	}
+
+	pool, _ = newServerPool(PROXY_BALANCE_LEAST_CONN, 0, nil)
+	pool.update([]Report{{Report: nerve.Report{Name: "a"}}, {Report: nerve.Report{Name: "b"}}})
+	pool.acquire(pool.pick(nil), nil)
+	if first, second := pool.servers[0], pool.pick(nil); first == second {
+		t.Errorf("least connection should pick the other server, was %s", second.name)
+	}
+
+	removed := pool.pick(nil)
+	pool.update([]Report{})
+	if pool.acquire(removed, &proxyConnection{}) {
+		t.Error("removed server should not be acquired")
+	}
+}
+
+func TestRouterProxyForward(t *testing.T) {
+	s := &Synapse{}
+	s.Init("version", "buildtime", true)
+	r := NewRouterProxy()
+	if err := r.Init(s); err != nil {
+		t.Fatal(err)
+	}
+
+	listenerA, reportA := proxyTestServer(t, "a")
+	defer listenerA.Close()
+	listenerB, reportB := proxyTestServer(t, "b")
+	listenerB.Close()
+
+	service := &Service{Name: "svc", typedRouterOptions: ProxyRouterOptions{Bind: "127.0.0.1:0"}}
+	if err := r.Update([]ServiceReport{{Service: service, Reports: []Report{reportB, reportA}}}); err != nil {
+		t.Fatal(err)
+	}
+	proxy := r.proxies[service.NameWithId()]
+	defer r.removeService(service)
+
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", proxy.listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		conn.Close()
+		if line != "a\n" {
+			t.Errorf("connection should be retried on server a, was '%s' %v", line, err)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package synapse
+
+import (
+	"strings"
+
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+)
+
+const (
+	SELECTOR_EQUALS     = "="
+	SELECTOR_NOT_EQUALS = "!="
+	SELECTOR_IN         = "in"
+	SELECTOR_NOT_IN     = "notin"
+	SELECTOR_EXISTS     = "exists"
+	SELECTOR_NOT_EXISTS = "!"
+)
+
+// same syntax as kubernetes label selectors: "role=read,version in (v1,v2),!canary"
+type LabelSelector []labelRequirement
+
+type labelRequirement struct {
+	key      string
+	operator string
+	values   map[string]struct{}
+}
+
+func ParseLabelSelector(selector string) (LabelSelector, error) {
+	fields := data.WithField("selector", selector)
+	res := LabelSelector{}
+	for _, expression := range splitSelector(selector) {
+		expression = strings.TrimSpace(expression)
+		if expression == "" {
+			continue
+		}
+		requirement, err := parseLabelRequirement(expression)
+		if err != nil {
+			return nil, errs.WithEF(err, fields, "Invalid label selector")
+		}
+		res = append(res, requirement)
+	}
+	return res, nil
+}
+
+// split on commas outside of parenthesis
+func splitSelector(selector string) []string {
+	res := []string{}
+	depth := 0
+	start := 0
+	for i, c := range selector {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				res = append(res, selector[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(res, selector[start:])
+}
+
+func parseLabelRequirement(expression string) (labelRequirement, error) {
+	fields := data.WithField("expression", expression)
+
+	if strings.HasPrefix(expression, "!") && !strings.ContainsAny(expression, "=( ") {
+		return labelRequirement{key: strings.TrimSpace(expression[1:]), operator: SELECTOR_NOT_EXISTS}, nil
+	}
+	if i := strings.Index(expression, "!="); i > 0 {
+		return newLabelRequirement(expression[:i], SELECTOR_NOT_EQUALS, expression[i+2:])
+	}
+	if i := strings.Index(expression, "=="); i > 0 {
+		return newLabelRequirement(expression[:i], SELECTOR_EQUALS, expression[i+2:])
+	}
+	if i := strings.Index(expression, "="); i > 0 {
+		return newLabelRequirement(expression[:i], SELECTOR_EQUALS, expression[i+1:])
+	}
+
+	parts := strings.Fields(expression)
+	if len(parts) == 1 && !strings.ContainsAny(parts[0], "=!()") {
+		return labelRequirement{key: parts[0], operator: SELECTOR_EXISTS}, nil
+	}
+	if len(parts) >= 2 && (parts[1] == SELECTOR_IN || parts[1] == SELECTOR_NOT_IN) {
+		values := strings.TrimSpace(strings.Join(parts[2:], " "))
+		if !strings.HasPrefix(values, "(") || !strings.HasSuffix(values, ")") {
+			return labelRequirement{}, errs.WithF(fields, "Set values must be in parenthesis")
+		}
+		return newLabelRequirement(parts[0], parts[1], strings.Split(values[1:len(values)-1], ",")...)
+	}
+	return labelRequirement{}, errs.WithF(fields, "Unsupported label selector expression")
+}
+
+func newLabelRequirement(key string, operator string, values ...string) (labelRequirement, error) {
+	r := labelRequirement{
+		key:      strings.TrimSpace(key),
+		operator: operator,
+		values:   make(map[string]struct{}),
+	}
+	if r.key == "" || strings.ContainsAny(r.key, "=!() ") {
+		return r, errs.WithF(data.WithField("key", r.key).WithField("operator", operator), "Invalid label selector key")
+	}
+	for _, value := range values {
+		r.values[strings.TrimSpace(value)] = struct{}{}
+	}
+	return r, nil
+}
+
+func (r labelRequirement) matches(labels map[string]string) bool {
+	value, ok := labels[r.key]
+	switch r.operator {
+	case SELECTOR_EXISTS:
+		return ok
+	case SELECTOR_NOT_EXISTS:
+		return !ok
+	case SELECTOR_EQUALS, SELECTOR_IN:
+		_, found := r.values[value]
+		return ok && found
+	case SELECTOR_NOT_EQUALS, SELECTOR_NOT_IN:
+		_, found := r.values[value]
+		return !ok || !found
+	}
+	return false
+}
+
+func (s LabelSelector) Matches(labels map[string]string) bool {
+	for _, requirement := range s {
+		if !requirement.matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s LabelSelector) filter(reports []Report) ([]Report, []Report) {
+	if len(s) == 0 {
+		return reports, nil
+	}
+	selected := []Report{}
+	excluded := []Report{}
+	for _, report := range reports {
+		if s.Matches(report.Labels) {
+			selected = append(selected, report)
+		} else {
+			excluded = append(excluded, report)
+		}
+	}
+	return selected, excluded
+}
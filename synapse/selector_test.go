@@ -0,0 +1,38 @@
+package synapse
+
+import "testing"
+
+func TestLabelSelectorMatches(t *testing.T) {
+	labels := map[string]string{"role": "read", "version": "v2", "zone": "a"}
+	for selector, expected := range map[string]bool{
+		"":                          true,
+		"role=read":                 true,
+		"role==read":                true,
+		"role=write":                false,
+		"role!=write":               true,
+		"canary!=true":              true,
+		"version in (v1, v2)":       true,
+		"version notin (v1,v2)":     false,
+		"zone notin (b)":            true,
+		"zone":                      true,
+		"!canary":                   true,
+		"!zone":                     false,
+		"role=read,version in (v2)": true,
+		"role=read,canary":          false,
+	} {
+		s, err := ParseLabelSelector(selector)
+		if err != nil {
+			t.Errorf("'%s' should parse: %s", selector, err)
+			continue
+		}
+		if res := s.Matches(labels); res != expected {
+			t.Errorf("'%s' should match %t, was %t", selector, expected, res)
+		}
+	}
+
+	for _, selector := range []string{"=read", "version in v1", "role read"} {
+		if _, err := ParseLabelSelector(selector); err == nil {
+			t.Errorf("'%s' should fail to parse", selector)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package synapse
+
+import (
+	"testing"
+
+	"github.com/blablacar/go-nerve/nerve"
+)
+
+func correlationTestReport(name string, host string, role string) Report {
+	return Report{Report: nerve.Report{Name: name, Host: host, Labels: map[string]string{"role": role}}}
+}
+
+func TestFilterCorrelation(t *testing.T) {
+	r := &RouterCommon{}
+	reads := []Report{
+		correlationTestReport("db1", "10.0.0.1", "master"),
+		correlationTestReport("db2", "10.0.0.2", "slave"),
+		correlationTestReport("db3", "10.0.0.3", "slave"),
+	}
+	writes := &ServiceReport{Reports: []Report{
+		correlationTestReport("db1-write", "10.0.0.1", "master"),
+		correlationTestReport("db2", "10.0.0.4", "master"),
+	}}
+
+	for _, test := range []struct {
+		correlation ServerCorrelation
+		expected    []string
+	}{
+		{ServerCorrelation{Type: CORRELATION_EXCLUDE_SERVER, Scope: CORRELATION_SCOPE_FIRST}, []string{"db1", "db2", "db3"}},
+		{ServerCorrelation{Type: CORRELATION_EXCLUDE_SERVER, Scope: CORRELATION_SCOPE_ALL}, []string{"db1", "db3"}},
+		{ServerCorrelation{Type: CORRELATION_EXCLUDE_SERVER, Scope: CORRELATION_SCOPE_HOST}, []string{"db2", "db3"}},
+		{ServerCorrelation{Type: CORRELATION_EXCLUDE_SERVER, Scope: CORRELATION_SCOPE_LABEL, Label: "role"}, []string{"db2", "db3"}},
+		{ServerCorrelation{Type: CORRELATION_INCLUDE_ONLY, Scope: CORRELATION_SCOPE_HOST}, []string{"db1"}},
+		{ServerCorrelation{Type: CORRELATION_INCLUDE_ONLY, Scope: CORRELATION_SCOPE_ALL}, []string{"db2"}},
+	} {
+		res := r.FilterCorrelation(ServiceReport{Service: &Service{ServerCorrelation: test.correlation}, Reports: reads}, writes)
+		names := []string{}
+		for _, report := range res.Reports {
+			names = append(names, report.Name)
+		}
+		if len(names) != len(test.expected) {
+			t.Errorf("%v should give %v, was %v", test.correlation, test.expected, names)
+			continue
+		}
+		for i := range names {
+			if names[i] != test.expected[i] {
+				t.Errorf("%v should give %v, was %v", test.correlation, test.expected, names)
+				break
+			}
+		}
+	}
+}
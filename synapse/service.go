@@ -5,6 +5,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"sync"
+	"text/template"
+	"time"
 
 	"github.com/n0rad/go-erlog/data"
 	"github.com/n0rad/go-erlog/errs"
@@ -56,23 +58,46 @@ func (s *ServiceReport) AvailableUnavailable() (int, int) {
 var idCount = 1
 var idCountMutex = sync.Mutex{}
 
+const CORRELATION_EXCLUDE_SERVER = "excludeServer"
+const CORRELATION_INCLUDE_ONLY = "includeOnly"
+
+const CORRELATION_SCOPE_FIRST = "first"
+const CORRELATION_SCOPE_ALL = "all"
+const CORRELATION_SCOPE_HOST = "host"
+const CORRELATION_SCOPE_LABEL = "label"
+
 type ServerCorrelation struct {
 	Type             string
 	OtherServiceName string
 	Scope            string
+	Label            string
 
 	otherService *Service
 }
 
 type Service struct {
-	Name              string
-	Watcher           json.RawMessage
-	RouterOptions     json.RawMessage
-	ServerOptions     json.RawMessage
-	ServerSort        ReportSortType
-	ServerCorrelation ServerCorrelation
+	Name                    string
+	Watcher                 json.RawMessage
+	RouterOptions           json.RawMessage
+	ServerOptions           json.RawMessage
+	ServerSort              ReportSortType
+	ServerCorrelation       ServerCorrelation
+	Selector                string
+	Locality                *Locality
+	MinHealthyPercent       int
+	MaxRemovalPercent       int
+	PanicMode               string
+	PanicKeepLastForInMilli int
+	FlapDamping             *FlapDamping
+	NoActiveServer          NoActiveServer
+	MaxReportAgeInMilli     int
+	ReportTimestampLabel    string
 
 	reported           bool
+	panicking          bool
+	panicSince         time.Time
+	nextReportExpiry   time.Time
+	removed            bool
 	id                 int
 	router             Router
 	synapse            *Synapse
@@ -80,6 +105,10 @@ type Service struct {
 	typedWatcher       Watcher
 	typedRouterOptions interface{}
 	typedServerOptions interface{}
+	typedSelector      LabelSelector
+	statusMutex        sync.RWMutex
+	servers            []Report
+	excluded           []Report
 }
 
 func (s *Service) NameWithId() string {
@@ -110,10 +139,16 @@ func (s *Service) Init(router Router, synapse *Synapse) error {
 	}
 
 	if s.ServerCorrelation.Type != "" {
-		if s.ServerCorrelation.Type != "excludeServer" {
+		if s.ServerCorrelation.Type != CORRELATION_EXCLUDE_SERVER && s.ServerCorrelation.Type != CORRELATION_INCLUDE_ONLY {
 			return errs.WithF(s.fields.WithField("type", s.ServerCorrelation.Type), "Unsupported serverCorrelation type")
 		}
-		if s.ServerCorrelation.Scope != "first" {
+		switch s.ServerCorrelation.Scope {
+		case CORRELATION_SCOPE_FIRST, CORRELATION_SCOPE_ALL, CORRELATION_SCOPE_HOST:
+		case CORRELATION_SCOPE_LABEL:
+			if s.ServerCorrelation.Label == "" {
+				return errs.WithF(s.fields, "Label is mandatory for serverCorrelation scope label")
+			}
+		default:
 			return errs.WithF(s.fields.WithField("scope", s.ServerCorrelation.Scope), "Unsupported serverCorrelation scope")
 		}
 		if os, err := s.router.GetService(s.ServerCorrelation.OtherServiceName); err != nil {
@@ -128,6 +163,46 @@ func (s *Service) Init(router Router, synapse *Synapse) error {
 		s.fields = s.fields.WithField("service", s.Name)
 	}
 
+	selector, err := ParseLabelSelector(s.Selector)
+	if err != nil {
+		return errs.WithEF(err, s.fields, "Failed to parse selector")
+	}
+	s.typedSelector = selector
+
+	if s.PanicMode == "" {
+		s.PanicMode = PANIC_KEEP_LAST
+	}
+	if s.PanicMode != PANIC_KEEP_LAST && s.PanicMode != PANIC_ENABLE_ALL {
+		return errs.WithF(s.fields.WithField("panicMode", s.PanicMode), "Unsupported panicMode")
+	}
+	if s.PanicKeepLastForInMilli == 0 {
+		s.PanicKeepLastForInMilli = 300000
+	}
+
+	if err := s.NoActiveServer.Init(s.fields); err != nil {
+		return errs.WithEF(err, s.fields, "Failed to init noActiveServer")
+	}
+
+	if s.FlapDamping != nil {
+		if err := s.FlapDamping.Init(s.fields); err != nil {
+			return errs.WithEF(err, s.fields, "Failed to init flapDamping")
+		}
+	}
+
+	if s.Locality != nil {
+		if err := s.Locality.Init(s.fields); err != nil {
+			return errs.WithEF(err, s.fields, "Failed to init locality")
+		}
+	}
+
+	if s.isTemplate() {
+		if _, err := template.New("routerOptions").Funcs(TemplateFunctions).Parse(string(s.RouterOptions)); err != nil {
+			return errs.WithEF(err, s.fields, "Failed to parse routerOptions template")
+		}
+		logs.WithF(s.fields).Info("Service template loaded")
+		return nil
+	}
+
 	if len([]byte(s.RouterOptions)) > 0 {
 		typedRouterOptions, err := router.ParseRouterOptions(s.RouterOptions)
 		if err != nil {
@@ -152,3 +227,9 @@ func (s *Service) Init(router Router, synapse *Synapse) error {
 	logs.WithF(s.fields.WithField("data", s)).Debug("Service loaded")
 	return nil
 }
+
+// a service template instantiate services for each path matched by its watcher
+func (s *Service) isTemplate() bool {
+	w, ok := s.typedWatcher.(*WatcherZookeeper)
+	return ok && w.isGlob()
+}
@@ -0,0 +1,83 @@
+package synapse
+
+import (
+	"sort"
+	"time"
+)
+
+type ServiceStatus struct {
+	Name     string         `json:"name"`
+	Reported bool           `json:"reported"`
+	Servers  []ServerStatus `json:"servers"`
+}
+
+type ServerStatus struct {
+	Name       string            `json:"name"`
+	Host       string            `json:"host"`
+	Port       int               `json:"port"`
+	Available  bool              `json:"available"`
+	Excluded   bool              `json:"excluded"`
+	Penalty    float64           `json:"penalty,omitempty"`
+	Suppressed bool              `json:"suppressed,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+}
+
+// last servers received from the watcher, after selector
+func (s *Service) setServers(servers []Report, excluded []Report) {
+	s.statusMutex.Lock()
+	defer s.statusMutex.Unlock()
+	s.servers = append([]Report{}, servers...)
+	s.excluded = append([]Report{}, excluded...)
+}
+
+func (s *Service) Status() ServiceStatus {
+	s.statusMutex.RLock()
+	defer s.statusMutex.RUnlock()
+
+	status := ServiceStatus{
+		Name:     s.Name,
+		Reported: s.reported,
+		Servers:  []ServerStatus{},
+	}
+	for _, report := range s.servers {
+		server := newServerStatus(report, false)
+		if s.FlapDamping != nil {
+			server.Penalty, server.Suppressed = s.FlapDamping.status(report.Name)
+		}
+		status.Servers = append(status.Servers, server)
+	}
+	for _, report := range s.excluded {
+		status.Servers = append(status.Servers, newServerStatus(report, true))
+	}
+	sort.Slice(status.Servers, func(i, j int) bool {
+		return status.Servers[i].Name < status.Servers[j].Name
+	})
+	return status
+}
+
+func (s *Service) watcherReports() []Report {
+	s.statusMutex.RLock()
+	defer s.statusMutex.RUnlock()
+	return append(append([]Report{}, s.servers...), s.excluded...)
+}
+
+func (s *Service) needsReevaluation(now time.Time) bool {
+	s.statusMutex.RLock()
+	reported := s.servers != nil
+	s.statusMutex.RUnlock()
+	return reported && (s.NoActiveServer.needsReevaluation(now) ||
+		!s.nextReportExpiry.IsZero() && !now.Before(s.nextReportExpiry) ||
+		s.FlapDamping != nil && s.FlapDamping.needsReevaluation(now) ||
+		s.PanicMode == PANIC_KEEP_LAST && s.panicExpired(now))
+}
+
+func newServerStatus(report Report, excluded bool) ServerStatus {
+	return ServerStatus{
+		Name:      report.Name,
+		Host:      report.Host,
+		Port:      int(report.Port),
+		Available: report.Available == nil || *report.Available,
+		Excluded:  excluded,
+		Labels:    report.Labels,
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/n0rad/go-erlog/logs"
 	"github.com/prometheus/client_golang/prometheus"
 	"net"
+	"sync"
 )
 
 type Synapse struct {
@@ -15,10 +16,17 @@ type Synapse struct {
 	ApiPort  int
 	Routers  []json.RawMessage
 
+	ZookeeperClusters map[string]*ZookeeperCluster
+
 	serviceAvailableCount   *prometheus.GaugeVec
 	serviceUnavailableCount *prometheus.GaugeVec
+	serviceExcludedCount    *prometheus.GaugeVec
+	servicePanics           *prometheus.GaugeVec
+	serverDampingPenalty    *prometheus.GaugeVec
 	routerUpdateFailures    *prometheus.GaugeVec
 	watcherFailures         *prometheus.GaugeVec
+	httpProxyRequests       *prometheus.CounterVec
+	httpProxyDuration       *prometheus.HistogramVec
 
 	fields           data.Fields
 	synapseVersion   string
@@ -26,6 +34,9 @@ type Synapse struct {
 	apiListener      net.Listener
 	typedRouters     []Router
 	context          *ContextImpl
+
+	zookeeperAuths      map[string]string
+	zookeeperAuthsMutex sync.Mutex
 }
 
 func (s *Synapse) Init(version string, buildTime string, logLevelIsSet bool) error {
@@ -61,6 +72,27 @@ func (s *Synapse) Init(version string, buildTime string, logLevelIsSet bool) err
 			Help:      "service unavailable status",
 		}, []string{"service"})
 
+	s.serviceExcludedCount = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "synapse",
+			Name:      "service_excluded_count",
+			Help:      "servers excluded by service selector",
+		}, []string{"service"})
+
+	s.servicePanics = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "synapse",
+			Name:      "service_panic",
+			Help:      "reports protected by panic threshold",
+		}, []string{"service", "reason"})
+
+	s.serverDampingPenalty = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "synapse",
+			Name:      "server_damping_penalty",
+			Help:      "flap damping penalty of servers",
+		}, []string{"service", "server"})
+
 	s.watcherFailures = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Namespace: "synapse",
@@ -68,22 +100,63 @@ func (s *Synapse) Init(version string, buildTime string, logLevelIsSet bool) err
 			Help:      "watcher failure",
 		}, []string{"service", "type"})
 
-	if err := prometheus.Register(s.watcherFailures); err != nil {
+	s.httpProxyRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "synapse",
+			Name:      "httpproxy_requests_total",
+			Help:      "requests proxied by httpproxy router",
+		}, []string{"service", "server", "code"})
+
+	s.httpProxyDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "synapse",
+			Name:      "httpproxy_request_duration_seconds",
+			Help:      "duration of requests proxied by httpproxy router",
+		}, []string{"service", "server"})
+
+	var err error
+	if s.watcherFailures, err = registerGaugeVec(s.watcherFailures); err != nil {
 		return errs.WithEF(err, s.fields, "Failed to register prometheus watcher_failure")
 	}
 
-	if err := prometheus.Register(s.serviceAvailableCount); err != nil {
+	if s.serviceAvailableCount, err = registerGaugeVec(s.serviceAvailableCount); err != nil {
 		return errs.WithEF(err, s.fields, "Failed to register prometheus service_available_count")
 	}
 
-	if err := prometheus.Register(s.serviceUnavailableCount); err != nil {
+	if s.serviceUnavailableCount, err = registerGaugeVec(s.serviceUnavailableCount); err != nil {
 		return errs.WithEF(err, s.fields, "Failed to register prometheus service_unavailable_count")
 	}
 
-	if err := prometheus.Register(s.routerUpdateFailures); err != nil {
+	if s.serviceExcludedCount, err = registerGaugeVec(s.serviceExcludedCount); err != nil {
+		return errs.WithEF(err, s.fields, "Failed to register prometheus service_excluded_count")
+	}
+
+	if s.servicePanics, err = registerGaugeVec(s.servicePanics); err != nil {
+		return errs.WithEF(err, s.fields, "Failed to register prometheus service_panic")
+	}
+
+	if s.serverDampingPenalty, err = registerGaugeVec(s.serverDampingPenalty); err != nil {
+		return errs.WithEF(err, s.fields, "Failed to register prometheus server_damping_penalty")
+	}
+
+	if s.routerUpdateFailures, err = registerGaugeVec(s.routerUpdateFailures); err != nil {
 		return errs.WithEF(err, s.fields, "Failed to register prometheus router_update_failure")
 	}
 
+	if s.httpProxyRequests, err = registerCounterVec(s.httpProxyRequests); err != nil {
+		return errs.WithEF(err, s.fields, "Failed to register prometheus httpproxy_requests_total")
+	}
+
+	if s.httpProxyDuration, err = registerHistogramVec(s.httpProxyDuration); err != nil {
+		return errs.WithEF(err, s.fields, "Failed to register prometheus httpproxy_request_duration_seconds")
+	}
+
+	for name, cluster := range s.ZookeeperClusters {
+		if err := cluster.Init(name); err != nil {
+			return errs.WithE(err, "Failed to init zookeeper cluster")
+		}
+	}
+
 	for _, data := range s.Routers {
 		router, err := RouterFromJson(data, s)
 		if err != nil {
@@ -98,11 +171,20 @@ func (s *Synapse) Init(version string, buildTime string, logLevelIsSet bool) err
 func (s *Synapse) Start(oneshot bool) error {
 	logs.Info("Starting synapse")
 
+	// api first, so a failed start leaves no router running
+	if err := s.startApi(); err != nil {
+		return err
+	}
 	s.context = newContext(oneshot)
-	for _, routers := range s.typedRouters {
-		go routers.Run(s.context)
+	for _, router := range s.typedRouters {
+		// registered before running, so an early Stop still waits for it
+		s.context.doneWaiter.Add(1)
+		go func(router Router) {
+			defer s.context.doneWaiter.Done()
+			router.Run(s.context)
+		}(router)
 	}
-	return s.startApi()
+	return nil
 }
 
 func (s *Synapse) Stop() {
@@ -112,3 +194,28 @@ func (s *Synapse) Stop() {
 	s.context.doneWaiter.Wait()
 	logs.Debug("All router stopped")
 }
+
+// metrics are kept across configuration reloads
+func registerGaugeVec(gauge *prometheus.GaugeVec) (*prometheus.GaugeVec, error) {
+	collector, err := prometheus.RegisterOrGet(gauge)
+	if err != nil {
+		return nil, err
+	}
+	return collector.(*prometheus.GaugeVec), nil
+}
+
+func registerCounterVec(counter *prometheus.CounterVec) (*prometheus.CounterVec, error) {
+	collector, err := prometheus.RegisterOrGet(counter)
+	if err != nil {
+		return nil, err
+	}
+	return collector.(*prometheus.CounterVec), nil
+}
+
+func registerHistogramVec(histogram *prometheus.HistogramVec) (*prometheus.HistogramVec, error) {
+	collector, err := prometheus.RegisterOrGet(histogram)
+	if err != nil {
+		return nil, err
+	}
+	return collector.(*prometheus.HistogramVec), nil
+}
@@ -1,6 +1,7 @@
 package synapse
 
 import (
+	"encoding/json"
 	"github.com/n0rad/go-erlog/data"
 	"github.com/n0rad/go-erlog/errs"
 	"github.com/n0rad/go-erlog/logs"
@@ -56,7 +57,7 @@ func (s *Synapse) startApi() error {
 	m.Get("/ready", func(ctx *macaron.Context) {
 		for _, router := range s.typedRouters {
 			for _, serviceName := range router.ServicesNames() {
-				if s, _ := router.GetService(serviceName); !s.reported {
+				if s, _ := router.GetService(serviceName); s != nil && !s.reported && !s.isTemplate() {
 					logs.WithF(s.fields.WithField("service", serviceName)).Warn("A service is not ready yet")
 					ctx.WriteHeader(http.StatusServiceUnavailable)
 					ctx.Resp.Write([]byte("false"))
@@ -68,11 +69,33 @@ func (s *Synapse) startApi() error {
 		ctx.Resp.Write([]byte("true"))
 	})
 
+	m.Get("/services", func(ctx *macaron.Context) {
+		services := []ServiceStatus{}
+		for _, router := range s.typedRouters {
+			for _, serviceName := range router.ServicesNames() {
+				if service, _ := router.GetService(serviceName); service != nil && !service.isTemplate() {
+					services = append(services, service.Status())
+				}
+			}
+		}
+		writeJson(ctx, services)
+	})
+
+	m.Get("/zookeeper", func(ctx *macaron.Context) {
+		clusters := make(map[string]ZookeeperClusterStatus)
+		for name, cluster := range s.ZookeeperClusters {
+			clusters[name] = cluster.Status()
+		}
+		writeJson(ctx, clusters)
+	})
+
 	m.Get("/metrics", prometheus.Handler())
 	m.Get("/", func() string {
 		return `/metrics
 /ready
-/version`
+/services
+/version
+/zookeeper`
 	})
 
 	logs.WithF(s.fields.WithField("url", url)).Info("Starting api")
@@ -87,6 +110,17 @@ func (s *Synapse) stopApi() {
 	s.apiListener = nil
 }
 
+func writeJson(ctx *macaron.Context, value interface{}) {
+	content, err := json.Marshal(value)
+	if err != nil {
+		logs.WithE(err).Error("Failed to marshal api response")
+		ctx.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	ctx.Resp.Header().Set("Content-Type", "application/json")
+	ctx.Resp.Write(content)
+}
+
 func Logger() macaron.Handler {
 	var reqCounter int64
 	return func(ctx *macaron.Context, log *log.Logger) {
@@ -0,0 +1,15 @@
+package synapse
+
+import (
+	"net"
+	"testing"
+)
+
+func freeTestPort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
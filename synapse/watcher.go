@@ -32,6 +32,20 @@ func (w *WatcherCommon) GetFields() data.Fields {
 	return w.fields
 }
 
+// unexpected content from the discovery backend, counted apart from watch failures
+type watcherContentError struct {
+	error
+}
+
+// any other error is a watch failure
+func (w *WatcherCommon) countFailure(err error) {
+	label := PrometheusLabelWatch
+	if _, ok := err.(watcherContentError); ok {
+		label = PrometheusLabelContent
+	}
+	w.service.synapse.watcherFailures.WithLabelValues(w.service.Name, label).Inc()
+}
+
 func WatcherFromJson(content []byte, service *Service) (Watcher, error) {
 	t := &WatcherCommon{}
 	if err := json.Unmarshal([]byte(content), t); err != nil {
@@ -43,6 +57,26 @@ func WatcherFromJson(content []byte, service *Service) (Watcher, error) {
 	switch t.Type {
 	case "zookeeper":
 		typedWatcher = NewWatcherZookeeper()
+	case "file":
+		typedWatcher = NewWatcherFile()
+	case "static":
+		typedWatcher = NewWatcherStatic()
+	case "dns":
+		typedWatcher = NewWatcherDns()
+	case "consul":
+		typedWatcher = NewWatcherConsul()
+	case "etcd":
+		typedWatcher = NewWatcherEtcd()
+	case "kubernetes":
+		typedWatcher = NewWatcherKubernetes()
+	case "http":
+		typedWatcher = NewWatcherHttp()
+	case "exec":
+		typedWatcher = NewWatcherExec()
+	case "docker":
+		typedWatcher = NewWatcherDocker()
+	case "composite":
+		typedWatcher = NewWatcherComposite()
 	default:
 		return nil, errs.WithF(fields, "Unsupported watcher type")
 	}
@@ -57,12 +91,16 @@ func WatcherFromJson(content []byte, service *Service) (Watcher, error) {
 	return typedWatcher, nil
 }
 
-func (w *WatcherZookeeper) changedToReport(reportsStop <-chan struct{}, events chan<- ServiceReport, s *Service) {
+func (w *WatcherCommon) changedToReport(reportsStop <-chan struct{}, events chan<- ServiceReport, s *Service) {
 	for {
 		select {
 		case <-w.reports.changed:
 			reports := w.reports.getValues()
-			events <- ServiceReport{Service: s, Reports: reports}
+			select {
+			case events <- ServiceReport{Service: s, Reports: reports}:
+			case <-reportsStop:
+				return
+			}
 		case <-reportsStop:
 			return
 		}
@@ -0,0 +1,188 @@
+package synapse
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+
+	"github.com/n0rad/go-erlog/errs"
+	"github.com/n0rad/go-erlog/logs"
+)
+
+const COMPOSITE_MERGE = "merge"
+const COMPOSITE_FAILOVER = "failover"
+
+type WatcherComposite struct {
+	WatcherCommon
+	Mode         string
+	MinAvailable int
+	OriginLabel  string
+	Sources      []CompositeSource
+
+	mutex          sync.Mutex
+	sourcesReports [][]Report
+	usedSources    string
+	reported       bool
+}
+
+type CompositeSource struct {
+	Name    string
+	Watcher json.RawMessage
+
+	typedWatcher Watcher
+}
+
+func NewWatcherComposite() *WatcherComposite {
+	return &WatcherComposite{
+		Mode:         COMPOSITE_FAILOVER,
+		MinAvailable: 1,
+		OriginLabel:  "origin",
+	}
+}
+
+func (w *WatcherComposite) GetServiceName() string {
+	if len(w.Sources) == 0 || w.Sources[0].typedWatcher == nil {
+		return ""
+	}
+	return w.Sources[0].typedWatcher.GetServiceName()
+}
+
+func (w *WatcherComposite) Init(service *Service) error {
+	if err := w.CommonInit(service); err != nil {
+		return errs.WithEF(err, w.fields, "Failed to init discovery")
+	}
+	w.fields = w.fields.WithField("mode", w.Mode)
+
+	if w.Mode != COMPOSITE_MERGE && w.Mode != COMPOSITE_FAILOVER {
+		return errs.WithF(w.fields, "Unsupported composite mode")
+	}
+	if len(w.Sources) == 0 {
+		return errs.WithF(w.fields, "Sources are mandatory for composite watcher")
+	}
+	if w.OriginLabel == "" {
+		return errs.WithF(w.fields, "originLabel cannot be empty")
+	}
+
+	names := make(map[string]struct{})
+	for i := range w.Sources {
+		source := &w.Sources[i]
+		typedWatcher, err := WatcherFromJson(source.Watcher, service)
+		if err != nil {
+			return errs.WithEF(err, w.fields.WithField("source", i), "Failed to init source watcher")
+		}
+		source.typedWatcher = typedWatcher
+		if source.Name == "" {
+			common := WatcherCommon{}
+			json.Unmarshal(source.Watcher, &common)
+			source.Name = common.Type
+		}
+		if _, ok := names[source.Name]; ok {
+			return errs.WithF(w.fields.WithField("source", source.Name), "Duplicate source name, set a name for each source")
+		}
+		names[source.Name] = struct{}{}
+	}
+	w.sourcesReports = make([][]Report, len(w.Sources))
+	return nil
+}
+
+func (w *WatcherComposite) Watch(context *ContextImpl, events chan<- ServiceReport, s *Service) {
+	context.doneWaiter.Add(1)
+	defer context.doneWaiter.Done()
+	w.service.synapse.watcherFailures.WithLabelValues(w.service.Name, PrometheusLabelWatch).Set(0)
+
+	reportsStop := make(chan struct{})
+	go w.changedToReport(reportsStop, events, s)
+
+	sourcesContext := newContext(context.oneshot)
+	forwardStop := make(chan struct{})
+	forwardStopWaiter := sync.WaitGroup{}
+	for i, source := range w.Sources {
+		sourceEvents := make(chan ServiceReport)
+		forwardStopWaiter.Add(1)
+		go w.forwardSource(i, sourceEvents, forwardStop, &forwardStopWaiter)
+		go source.typedWatcher.Watch(sourcesContext, sourceEvents, s)
+	}
+
+	<-context.stop
+	logs.WithF(w.fields).Debug("Stopping watcher")
+	close(sourcesContext.stop)
+	sourcesContext.doneWaiter.Wait()
+	close(forwardStop)
+	forwardStopWaiter.Wait()
+	close(reportsStop)
+	logs.WithF(w.fields).Debug("Watcher stopped")
+}
+
+func (w *WatcherComposite) forwardSource(i int, sourceEvents <-chan ServiceReport, stop <-chan struct{}, doneWaiter *sync.WaitGroup) {
+	defer doneWaiter.Done()
+
+	for {
+		select {
+		case event := <-sourceEvents:
+			w.mutex.Lock()
+			w.sourcesReports[i] = event.Reports
+			reports := w.combine()
+			if !w.reported || !w.reports.sameAs(reports) {
+				w.reported = true
+				w.reports.replaceAll(reports)
+			}
+			w.mutex.Unlock()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// servers of sources taken in order, until minAvailable is reached
+func (w *WatcherComposite) combine() map[string]Report {
+	used := []int{}
+	if w.Mode == COMPOSITE_FAILOVER {
+		best := 0
+		for i := range w.Sources {
+			if availableCount(w.sourcesReports[i]) >= w.MinAvailable {
+				best = i
+				break
+			}
+			if availableCount(w.sourcesReports[i]) > availableCount(w.sourcesReports[best]) {
+				best = i
+			}
+		}
+		used = append(used, best)
+	} else {
+		available := 0
+		for i := range w.Sources {
+			used = append(used, i)
+			available += availableCount(w.sourcesReports[i])
+			if available >= w.MinAvailable {
+				break
+			}
+		}
+	}
+
+	reports := make(map[string]Report)
+	names := []string{}
+	for _, i := range used {
+		names = append(names, w.Sources[i].Name)
+		for _, report := range w.sourcesReports[i] {
+			labels := make(map[string]string, len(report.Labels)+1)
+			for k, v := range report.Labels {
+				labels[k] = v
+			}
+			labels[w.OriginLabel] = w.Sources[i].Name
+			report.Labels = labels
+			report.Name = w.Sources[i].Name + "/" + report.Name
+			reports[report.Name] = report
+		}
+	}
+
+	if usedSources := strings.Join(names, ","); usedSources != w.usedSources {
+		logs.WithF(w.fields.WithField("sources", usedSources).WithField("previous", w.usedSources)).Info("Composite sources changed")
+		w.usedSources = usedSources
+	}
+	return reports
+}
+
+func availableCount(reports []Report) int {
+	available, _ := (&ServiceReport{Reports: reports}).AvailableUnavailable()
+	return available
+}
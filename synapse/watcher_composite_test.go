@@ -0,0 +1,78 @@
+package synapse
+
+import (
+	"testing"
+
+	"github.com/blablacar/go-nerve/nerve"
+)
+
+func compositeTestReport(name string, available bool) Report {
+	return Report{Report: nerve.Report{Name: name, Host: "10.0.0.1", Port: 80, Available: &available}}
+}
+
+func TestWatcherCompositeCombine(t *testing.T) {
+	s := &Synapse{}
+	s.Init("version", "buildtime", true)
+
+	w := NewWatcherComposite()
+	w.MinAvailable = 2
+	w.Sources = []CompositeSource{
+		{Name: "dc1", Watcher: []byte(`{"type": "static", "servers": [{"host": "10.0.0.1", "port": 80}]}`)},
+		{Name: "dc2", Watcher: []byte(`{"type": "static", "servers": [{"host": "10.0.0.2", "port": 80}]}`)},
+	}
+	if err := w.Init(&Service{Name: "ServiceA", synapse: s}); err != nil {
+		t.Fatal(err)
+	}
+
+	w.sourcesReports[0] = []Report{compositeTestReport("a1", true), compositeTestReport("a2", true)}
+	w.sourcesReports[1] = []Report{compositeTestReport("b1", true)}
+	reports := w.combine()
+	if len(reports) != 2 || reports["dc1/a1"].Labels["origin"] != "dc1" {
+		t.Errorf("failover should use dc1 only, was %v", reports)
+	}
+
+	w.sourcesReports[0] = []Report{compositeTestReport("a1", true), compositeTestReport("a2", false)}
+	reports = w.combine()
+	if len(reports) != 2 || reports["dc1/a1"].Name != "dc1/a1" {
+		t.Errorf("failover should keep dc1 having most available servers, was %v", reports)
+	}
+	w.sourcesReports[1] = append(w.sourcesReports[1], compositeTestReport("b2", true))
+	reports = w.combine()
+	if len(reports) != 2 || reports["dc2/b1"].Labels["origin"] != "dc2" {
+		t.Errorf("failover should use dc2, was %v", reports)
+	}
+
+	w.Mode = COMPOSITE_MERGE
+	reports = w.combine()
+	if len(reports) != 4 {
+		t.Errorf("merge should use both sources, was %v", reports)
+	}
+	w.sourcesReports[0][1] = compositeTestReport("a2", true)
+	reports = w.combine()
+	if len(reports) != 2 {
+		t.Errorf("merge should use dc1 only, was %v", reports)
+	}
+}
+
+func TestWatcherCompositeCollidingNames(t *testing.T) {
+	s := &Synapse{}
+	s.Init("version", "buildtime", true)
+
+	w := NewWatcherComposite()
+	w.Mode = COMPOSITE_MERGE
+	w.MinAvailable = 2
+	w.Sources = []CompositeSource{
+		{Name: "dc1", Watcher: []byte(`{"type": "static", "servers": [{"host": "10.0.0.1", "port": 80}]}`)},
+		{Name: "dc2", Watcher: []byte(`{"type": "static", "servers": [{"host": "10.0.0.2", "port": 80}]}`)},
+	}
+	if err := w.Init(&Service{Name: "ServiceA", synapse: s}); err != nil {
+		t.Fatal(err)
+	}
+
+	w.sourcesReports[0] = []Report{compositeTestReport("server", true)}
+	w.sourcesReports[1] = []Report{compositeTestReport("server", true)}
+	reports := w.combine()
+	if len(reports) != 2 || reports["dc1/server"].Name != "dc1/server" || reports["dc2/server"].Name != "dc2/server" {
+		t.Errorf("servers with the same name in both sources should be kept apart, was %v", reports)
+	}
+}
@@ -0,0 +1,252 @@
+package synapse
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blablacar/go-nerve/nerve"
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+	"github.com/n0rad/go-erlog/logs"
+)
+
+type WatcherConsul struct {
+	WatcherCommon
+	Address        string
+	Service        string
+	Tag            string
+	Datacenter     string
+	Token          string
+	WaitInMilli    int
+	TimeoutInMilli int
+
+	client *http.Client
+}
+
+type consulHealthEntry struct {
+	Node struct {
+		Node    string
+		Address string
+	}
+	Service struct {
+		ID          string
+		Service     string
+		Tags        []string
+		Address     string
+		Port        int
+		Meta        map[string]string
+		CreateIndex int64
+		Weights     *struct {
+			Passing int
+			Warning int
+		}
+	}
+	Checks []struct {
+		CheckID string
+		Status  string
+		Output  string
+	}
+}
+
+func NewWatcherConsul() *WatcherConsul {
+	return &WatcherConsul{
+		Address:        "http://127.0.0.1:8500",
+		WaitInMilli:    60000,
+		TimeoutInMilli: 5000,
+	}
+}
+
+func (w *WatcherConsul) GetServiceName() string {
+	return w.Service
+}
+
+func (w *WatcherConsul) Init(service *Service) error {
+	if err := w.CommonInit(service); err != nil {
+		return errs.WithEF(err, w.fields, "Failed to init discovery")
+	}
+	w.fields = w.fields.WithField("address", w.Address).WithField("service", w.Service)
+
+	if w.Service == "" {
+		return errs.WithF(w.fields, "Service is mandatory for consul watcher")
+	}
+	if !strings.Contains(w.Address, "://") {
+		w.Address = "http://" + w.Address
+	}
+	w.Address = strings.TrimSuffix(w.Address, "/")
+	if _, err := url.Parse(w.Address); err != nil {
+		return errs.WithEF(err, w.fields, "Invalid consul address")
+	}
+
+	// blocking queries are hold by consul up to wait + wait/16
+	w.client = &http.Client{
+		Timeout: time.Duration(w.WaitInMilli+w.WaitInMilli/16+w.TimeoutInMilli) * time.Millisecond,
+	}
+	return nil
+}
+
+func (w *WatcherConsul) Watch(context *ContextImpl, events chan<- ServiceReport, s *Service) {
+	context.doneWaiter.Add(1)
+	defer context.doneWaiter.Done()
+	w.service.synapse.watcherFailures.WithLabelValues(w.service.Name, PrometheusLabelWatch).Set(0)
+
+	reportsStop := make(chan struct{})
+	go w.changedToReport(reportsStop, events, s)
+
+	watcherStop := make(chan struct{})
+	watcherStopWaiter := sync.WaitGroup{}
+	go w.watchService(watcherStop, &watcherStopWaiter)
+
+	<-context.stop
+	logs.WithF(w.fields).Debug("Stopping watcher")
+	close(watcherStop)
+	watcherStopWaiter.Wait()
+	close(reportsStop)
+	logs.WithF(w.fields).Debug("Watcher stopped")
+}
+
+func (w *WatcherConsul) watchService(stop <-chan struct{}, doneWaiter *sync.WaitGroup) {
+	doneWaiter.Add(1)
+	defer doneWaiter.Done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	var index uint64
+	for {
+		entries, newIndex, err := w.query(ctx, index)
+		if err != nil {
+			if isStopped(stop) {
+				return
+			}
+			w.countFailure(err)
+			logs.WithEF(err, w.fields).Warn("Failed to query consul health. Retry in 1s")
+			<-time.After(time.Duration(1000) * time.Millisecond)
+
+			if isStopped(stop) {
+				return
+			}
+			continue
+		}
+
+		// index went backward, consul state was reset
+		if newIndex < index {
+			newIndex = 0
+		}
+		if newIndex != index {
+			w.reports.replaceAll(w.toReports(entries))
+		}
+		index = newIndex
+
+		if isStopped(stop) {
+			return
+		}
+	}
+}
+
+func (w *WatcherConsul) query(ctx context.Context, index uint64) ([]consulHealthEntry, uint64, error) {
+	params := url.Values{}
+	if index > 0 {
+		params.Set("index", strconv.FormatUint(index, 10))
+		params.Set("wait", strconv.Itoa(w.WaitInMilli)+"ms")
+	}
+	if w.Tag != "" {
+		params.Set("tag", w.Tag)
+	}
+	if w.Datacenter != "" {
+		params.Set("dc", w.Datacenter)
+	}
+	u := w.Address + "/v1/health/service/" + url.PathEscape(w.Service) + "?" + params.Encode()
+	fields := w.fields.WithField("url", u)
+
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, index, errs.WithEF(err, fields, "Failed to prepare consul request")
+	}
+	if w.Token != "" {
+		req.Header.Set("X-Consul-Token", w.Token)
+	}
+	resp, err := w.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, index, errs.WithEF(err, fields, "Consul request failed")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, index, errs.WithF(fields.WithField("status", resp.StatusCode), "Bad consul response status")
+	}
+
+	newIndex, err := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil || newIndex == 0 {
+		return nil, index, errs.WithEF(err, fields.WithField("index", resp.Header.Get("X-Consul-Index")), "Invalid X-Consul-Index header")
+	}
+
+	var entries []consulHealthEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, index, watcherContentError{errs.WithEF(err, fields, "Failed to unmarshal consul response")}
+	}
+	return entries, newIndex, nil
+}
+
+func (w *WatcherConsul) toReports(entries []consulHealthEntry) map[string]Report {
+	reports := make(map[string]Report)
+	for _, entry := range entries {
+		available := true
+		reasons := []string{}
+		for _, check := range entry.Checks {
+			if check.Status != "passing" {
+				available = false
+				reasons = append(reasons, check.CheckID+": "+check.Status)
+			}
+		}
+
+		host := entry.Service.Address
+		if host == "" {
+			host = entry.Node.Address
+		}
+
+		labels := make(map[string]string)
+		for k, v := range entry.Service.Meta {
+			labels[k] = v
+		}
+		if len(entry.Service.Tags) > 0 {
+			tags := append([]string{}, entry.Service.Tags...)
+			sort.Strings(tags)
+			labels["tags"] = strings.Join(tags, ",")
+		}
+
+		r := nerve.Report{
+			Available:         &available,
+			UnavailableReason: strings.Join(reasons, ", "),
+			Host:              host,
+			Port:              nerve.Port(entry.Service.Port),
+			Name:              entry.Node.Node + "_" + entry.Service.ID,
+			Labels:            labels,
+		}
+		if entry.Service.Weights != nil {
+			weight := entry.Service.Weights.Passing
+			if weight > 255 {
+				weight = 255
+			}
+			r.Weight = uint8Ptr(uint8(weight))
+		}
+		if !available {
+			r.Weight = uint8Ptr(0)
+		}
+
+		if logs.IsTraceEnabled() {
+			logs.WithF(w.fields.WithFields(data.Fields{"node": entry.Node.Node, "report": r})).Trace("Consul entry converted")
+		}
+		reports[r.Name] = Report{Report: r, CreationTime: entry.Service.CreateIndex}
+	}
+	return reports
+}
@@ -0,0 +1,86 @@
+package synapse
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+const consulHealthResponse = `[
+  {
+    "Node": {"Node": "node1", "Address": "10.0.0.1"},
+    "Service": {"ID": "api1", "Service": "api", "Tags": ["v2", "primary"], "Port": 8080, "Meta": {"zone": "a"}, "CreateIndex": 12, "Weights": {"Passing": 10, "Warning": 1}},
+    "Checks": [{"CheckID": "serfHealth", "Status": "passing"}, {"CheckID": "service:api1", "Status": "passing"}]
+  },
+  {
+    "Node": {"Node": "node2", "Address": "10.0.0.2"},
+    "Service": {"ID": "api2", "Service": "api", "Address": "10.0.1.2", "Port": 8080, "CreateIndex": 14},
+    "Checks": [{"CheckID": "serfHealth", "Status": "passing"}, {"CheckID": "service:api2", "Status": "critical"}]
+  }
+]`
+
+func TestWatcherConsul(t *testing.T) {
+	var lastQuery string
+	var queryMutex sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/health/service/api" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		queryMutex.Lock()
+		lastQuery = r.URL.RawQuery
+		queryMutex.Unlock()
+		if r.URL.Query().Get("index") == "42" {
+			time.Sleep(50 * time.Millisecond)
+		}
+		w.Header().Set("X-Consul-Index", "42")
+		w.Write([]byte(consulHealthResponse))
+	}))
+	defer server.Close()
+
+	s := &Synapse{}
+	s.Init("version", "buildtime", true)
+
+	w := NewWatcherConsul()
+	w.Address = server.URL
+	w.Service = "api"
+	w.WaitInMilli = 100
+	service := &Service{Name: "api", synapse: s}
+	if err := w.Init(service); err != nil {
+		t.Fatal(err)
+	}
+
+	context := newContext(false)
+	events := make(chan ServiceReport)
+	go w.Watch(context, events, service)
+
+	event := <-events
+	if len(event.Reports) != 2 {
+		t.Fatalf("should have 2 reports, was %v", event)
+	}
+	for _, r := range event.Reports {
+		switch r.Name {
+		case "node1_api1":
+			if !*r.Available || r.Host != "10.0.0.1" || *r.Weight != 10 || r.Labels["zone"] != "a" || r.Labels["tags"] != "primary,v2" || r.CreationTime != 12 {
+				t.Errorf("Unexpected report for node1: %v %v", r, r.Labels)
+			}
+		case "node2_api2":
+			if *r.Available || r.Host != "10.0.1.2" {
+				t.Errorf("node2 should be unavailable with service address, was %v", r)
+			}
+		default:
+			t.Errorf("Unexpected report %v", r)
+		}
+	}
+
+	time.Sleep(80 * time.Millisecond)
+	close(context.stop)
+	context.doneWaiter.Wait()
+	queryMutex.Lock()
+	defer queryMutex.Unlock()
+	if lastQuery != "index=42&wait=100ms" {
+		t.Errorf("Should long poll with last index, was %s", lastQuery)
+	}
+}
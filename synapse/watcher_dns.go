@@ -0,0 +1,224 @@
+package synapse
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blablacar/go-nerve/nerve"
+	"github.com/n0rad/go-erlog/errs"
+	"github.com/n0rad/go-erlog/logs"
+)
+
+const DNS_SRV = "srv"
+const DNS_A = "a"
+const DNS_AAAA = "aaaa"
+
+type WatcherDns struct {
+	WatcherCommon
+	Name            string
+	RecordType      string
+	Port            int
+	Server          string
+	IntervalInMilli int
+	TimeoutInMilli  int
+
+	resolver   *net.Resolver
+	firstSeens firstSeenTimes
+}
+
+func NewWatcherDns() *WatcherDns {
+	return &WatcherDns{
+		RecordType:      DNS_SRV,
+		IntervalInMilli: 10000,
+		TimeoutInMilli:  2000,
+	}
+}
+
+func (w *WatcherDns) GetServiceName() string {
+	return strings.Replace(strings.TrimSuffix(w.Name, "."), ".", "_", -1)
+}
+
+func (w *WatcherDns) Init(service *Service) error {
+	if err := w.CommonInit(service); err != nil {
+		return errs.WithEF(err, w.fields, "Failed to init discovery")
+	}
+	w.fields = w.fields.WithField("name", w.Name)
+
+	if w.Name == "" {
+		return errs.WithF(w.fields, "Name is mandatory for dns watcher")
+	}
+	w.RecordType = strings.ToLower(w.RecordType)
+	switch w.RecordType {
+	case DNS_SRV:
+	case DNS_A, DNS_AAAA:
+		if w.Port <= 0 {
+			return errs.WithF(w.fields, "Port is mandatory for A/AAAA dns records")
+		}
+	default:
+		return errs.WithF(w.fields.WithField("recordType", w.RecordType), "Unsupported dns record type")
+	}
+	if w.IntervalInMilli <= 0 {
+		return errs.WithF(w.fields.WithField("intervalInMilli", w.IntervalInMilli), "intervalInMilli must be positive")
+	}
+	if w.TimeoutInMilli <= 0 {
+		return errs.WithF(w.fields.WithField("timeoutInMilli", w.TimeoutInMilli), "timeoutInMilli must be positive")
+	}
+
+	w.resolver = net.DefaultResolver
+	if w.Server != "" {
+		if _, _, err := net.SplitHostPort(w.Server); err != nil {
+			w.Server = net.JoinHostPort(w.Server, "53")
+		}
+		w.fields = w.fields.WithField("server", w.Server)
+		w.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				d := net.Dialer{}
+				return d.DialContext(ctx, network, w.Server)
+			},
+		}
+	}
+	w.firstSeens = make(firstSeenTimes)
+	return nil
+}
+
+func (w *WatcherDns) Watch(context *ContextImpl, events chan<- ServiceReport, s *Service) {
+	context.doneWaiter.Add(1)
+	defer context.doneWaiter.Done()
+	w.service.synapse.watcherFailures.WithLabelValues(w.service.Name, PrometheusLabelWatch).Set(0)
+
+	reportsStop := make(chan struct{})
+	go w.changedToReport(reportsStop, events, s)
+
+	watcherStop := make(chan struct{})
+	watcherStopWaiter := sync.WaitGroup{}
+	go w.watchRecords(watcherStop, &watcherStopWaiter)
+
+	<-context.stop
+	logs.WithF(w.fields).Debug("Stopping watcher")
+	close(watcherStop)
+	watcherStopWaiter.Wait()
+	close(reportsStop)
+	logs.WithF(w.fields).Debug("Watcher stopped")
+}
+
+func (w *WatcherDns) watchRecords(stop <-chan struct{}, doneWaiter *sync.WaitGroup) {
+	doneWaiter.Add(1)
+	defer doneWaiter.Done()
+
+	first := true
+	for {
+		reports, err := w.resolve()
+		if err != nil {
+			w.countFailure(err)
+			logs.WithEF(err, w.fields).Warn("Failed to resolve dns records. Keeping previous servers")
+		} else if first || !w.reports.sameAs(reports) {
+			first = false
+			w.reports.replaceAll(reports)
+		}
+
+		select {
+		case <-time.After(time.Duration(w.IntervalInMilli) * time.Millisecond):
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (w *WatcherDns) resolve() (map[string]Report, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(w.TimeoutInMilli)*time.Millisecond)
+	defer cancel()
+
+	reports := make(map[string]Report)
+	switch w.RecordType {
+	case DNS_A, DNS_AAAA:
+		network := "ip4"
+		if w.RecordType == DNS_AAAA {
+			network = "ip6"
+		}
+		ips, err := w.resolver.LookupIP(ctx, network, w.Name)
+		if err != nil {
+			return nil, errs.WithEF(err, w.fields, "Failed to lookup ip addresses")
+		}
+		for _, ip := range ips {
+			w.addReport(reports, ip.String(), w.Port, nil)
+		}
+	default:
+		_, srvs, err := w.resolver.LookupSRV(ctx, "", "", w.Name)
+		if err != nil {
+			return nil, errs.WithEF(err, w.fields, "Failed to lookup srv records")
+		}
+		var maxWeight uint16
+		for _, srv := range srvs {
+			if srv.Weight > maxWeight {
+				maxWeight = srv.Weight
+			}
+		}
+		for _, srv := range srvs {
+			host, err := w.lookupTarget(ctx, srv.Target)
+			if err != nil {
+				return nil, err
+			}
+			w.addReport(reports, host, int(srv.Port), &nerve.Report{
+				Name:   strings.TrimSuffix(srv.Target, ".") + ":" + strconv.Itoa(int(srv.Port)),
+				Weight: uint8Ptr(srvWeight(srv.Weight, maxWeight)),
+				Labels: map[string]string{"priority": strconv.Itoa(int(srv.Priority))},
+			})
+		}
+	}
+
+	w.firstSeens.retain(reports)
+	return reports, nil
+}
+
+func (w *WatcherDns) lookupTarget(ctx context.Context, target string) (string, error) {
+	if ip := net.ParseIP(strings.TrimSuffix(target, ".")); ip != nil {
+		return ip.String(), nil
+	}
+	ips, err := w.resolver.LookupIPAddr(ctx, target)
+	if err != nil || len(ips) == 0 {
+		return "", errs.WithEF(err, w.fields.WithField("target", target), "Failed to lookup srv target")
+	}
+	for _, ip := range ips {
+		if ip.IP.To4() != nil {
+			return ip.IP.String(), nil
+		}
+	}
+	return ips[0].IP.String(), nil
+}
+
+func (w *WatcherDns) addReport(reports map[string]Report, host string, port int, base *nerve.Report) {
+	r := nerve.Report{}
+	if base != nil {
+		r = *base
+	}
+	if r.Name == "" {
+		r.Name = net.JoinHostPort(host, strconv.Itoa(port))
+	}
+	available := true
+	r.Available = &available
+	r.Host = host
+	r.Port = nerve.Port(port)
+
+	reports[r.Name] = Report{Report: r, CreationTime: w.firstSeens.get(r.Name)}
+}
+
+// srv weights are scaled to 1..255 relatively to the biggest one, since a weight of 0 means draining for routers
+func srvWeight(weight uint16, maxWeight uint16) uint8 {
+	if maxWeight == 0 {
+		return 1
+	}
+	scaled := (int(weight)*255 + int(maxWeight) - 1) / int(maxWeight)
+	if scaled < 1 {
+		scaled = 1
+	}
+	return uint8(scaled)
+}
+
+func uint8Ptr(i uint8) *uint8 {
+	return &i
+}
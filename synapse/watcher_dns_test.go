@@ -0,0 +1,165 @@
+package synapse
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// answers records of the zone by name and type
+func dnsTestServer(t *testing.T, zone map[string][]dnsmessage.Resource) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buff := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buff)
+			if err != nil {
+				return
+			}
+			var parser dnsmessage.Parser
+			header, err := parser.Start(buff[:n])
+			if err != nil {
+				continue
+			}
+			question, err := parser.Question()
+			if err != nil {
+				continue
+			}
+
+			response := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: header.ID, Response: true, Authoritative: true},
+				Questions: []dnsmessage.Question{question},
+			}
+			for _, record := range zone[question.Name.String()] {
+				if record.Header.Type == question.Type {
+					record.Header.Name = question.Name
+					record.Header.Class = dnsmessage.ClassINET
+					response.Answers = append(response.Answers, record)
+				}
+			}
+			if packed, err := response.Pack(); err == nil {
+				conn.WriteTo(packed, addr)
+			}
+		}
+	}()
+	return conn
+}
+
+func dnsTestA(ip string) dnsmessage.Resource {
+	a := dnsmessage.AResource{}
+	copy(a.A[:], net.ParseIP(ip).To4())
+	return dnsmessage.Resource{Header: dnsmessage.ResourceHeader{Type: dnsmessage.TypeA}, Body: &a}
+}
+
+func dnsTestAAAA(ip string) dnsmessage.Resource {
+	aaaa := dnsmessage.AAAAResource{}
+	copy(aaaa.AAAA[:], net.ParseIP(ip))
+	return dnsmessage.Resource{Header: dnsmessage.ResourceHeader{Type: dnsmessage.TypeAAAA}, Body: &aaaa}
+}
+
+func dnsTestSRV(target string, port uint16, weight uint16) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Type: dnsmessage.TypeSRV},
+		Body:   &dnsmessage.SRVResource{Priority: 10, Weight: weight, Port: port, Target: dnsmessage.MustNewName(target)},
+	}
+}
+
+func TestWatcherDnsResolve(t *testing.T) {
+	server := dnsTestServer(t, map[string][]dnsmessage.Resource{
+		"_api._tcp.service.test.": {
+			dnsTestSRV("api1.service.test.", 8080, 60),
+			dnsTestSRV("api2.service.test.", 8080, 10),
+			dnsTestSRV("api3.service.test.", 8081, 0),
+		},
+		"api1.service.test.": {dnsTestA("10.0.0.1")},
+		"api2.service.test.": {dnsTestA("10.0.0.2")},
+		"api3.service.test.": {dnsTestAAAA("fd00::3")},
+		"web.service.test.":  {dnsTestA("10.0.1.1"), dnsTestAAAA("fd00::1:1")},
+	})
+	defer server.Close()
+
+	s := &Synapse{}
+	s.Init("version", "buildtime", true)
+
+	for _, test := range []struct {
+		name       string
+		recordType string
+		expected   map[string]string
+		weights    map[string]uint8
+	}{
+		{"_api._tcp.service.test.", DNS_SRV,
+			map[string]string{"api1.service.test:8080": "10.0.0.1", "api2.service.test:8080": "10.0.0.2", "api3.service.test:8081": "fd00::3"},
+			map[string]uint8{"api1.service.test:8080": 255, "api2.service.test:8080": 43, "api3.service.test:8081": 1}},
+		{"web.service.test.", DNS_A, map[string]string{"10.0.1.1:80": "10.0.1.1"}, nil},
+		{"web.service.test.", DNS_AAAA, map[string]string{"[fd00::1:1]:80": "fd00::1:1"}, nil},
+	} {
+		w := NewWatcherDns()
+		w.Name = test.name
+		w.RecordType = test.recordType
+		w.Port = 80
+		w.Server = server.LocalAddr().String()
+		if err := w.Init(&Service{Name: "api", synapse: s}); err != nil {
+			t.Fatal(err)
+		}
+
+		reports, err := w.resolve()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(reports) != len(test.expected) {
+			t.Errorf("%s %s should resolve %v, was %v", test.recordType, test.name, test.expected, reports)
+		}
+		for name, host := range test.expected {
+			if reports[name].Host != host {
+				t.Errorf("%s should have host %s, was %v", name, host, reports[name])
+			}
+			if weight, ok := test.weights[name]; ok && *reports[name].Weight != weight {
+				t.Errorf("%s should have weight %d, was %d", name, weight, *reports[name].Weight)
+			}
+		}
+	}
+}
+
+func TestWatcherDnsInit(t *testing.T) {
+	s := &Synapse{}
+	s.Init("version", "buildtime", true)
+
+	for _, test := range []struct {
+		watcher *WatcherDns
+		fails   bool
+	}{
+		{&WatcherDns{Name: "_api._tcp.service.test", RecordType: DNS_SRV, IntervalInMilli: 1000, TimeoutInMilli: 1000}, false},
+		{&WatcherDns{Name: "web.service.test", RecordType: "AAAA", Port: 80, IntervalInMilli: 1000, TimeoutInMilli: 1000}, false},
+		{&WatcherDns{Name: "web.service.test", RecordType: DNS_A, IntervalInMilli: 1000, TimeoutInMilli: 1000}, true},
+		{&WatcherDns{Name: "web.service.test", RecordType: "mx", IntervalInMilli: 1000, TimeoutInMilli: 1000}, true},
+		{&WatcherDns{Name: "_api._tcp.service.test", RecordType: DNS_SRV, IntervalInMilli: 1000}, true},
+		{&WatcherDns{Name: "_api._tcp.service.test", RecordType: DNS_SRV, TimeoutInMilli: 1000}, true},
+	} {
+		if err := test.watcher.Init(&Service{Name: "api", synapse: s}); (err != nil) != test.fails {
+			t.Errorf("unexpected init result for %v: %v", test.watcher, err)
+		}
+	}
+}
+
+func TestSrvWeight(t *testing.T) {
+	for _, test := range []struct {
+		weight    uint16
+		maxWeight uint16
+		expected  uint8
+	}{
+		{0, 0, 1},
+		{0, 100, 1},
+		{1, 65535, 1},
+		{50, 100, 128},
+		{100, 100, 255},
+		{65535, 65535, 255},
+	} {
+		if res := srvWeight(test.weight, test.maxWeight); res != test.expected {
+			t.Errorf("weight %d of %d should be %d, was %d", test.weight, test.maxWeight, test.expected, res)
+		}
+	}
+}
@@ -0,0 +1,339 @@
+package synapse
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blablacar/go-nerve/nerve"
+	"github.com/n0rad/go-erlog/errs"
+	"github.com/n0rad/go-erlog/logs"
+)
+
+type WatcherDocker struct {
+	WatcherCommon
+	Host             string
+	Label            string
+	Port             int
+	Network          string
+	UsePublishedPort bool
+	TimeoutInMilli   int
+
+	client  *http.Client
+	baseUrl string
+}
+
+type dockerContainer struct {
+	Id      string
+	Name    string
+	Created time.Time
+	State   struct {
+		Running bool
+		Health  *struct {
+			Status string
+		}
+	}
+	Config struct {
+		Labels       map[string]string
+		ExposedPorts map[string]struct{}
+	}
+	NetworkSettings struct {
+		IPAddress string
+		Ports     map[string][]struct {
+			HostIp   string
+			HostPort string
+		}
+		Networks map[string]struct {
+			IPAddress string
+		}
+	}
+}
+
+type dockerEvent struct {
+	Type   string
+	Action string
+	Actor  struct {
+		ID string
+	}
+}
+
+func NewWatcherDocker() *WatcherDocker {
+	return &WatcherDocker{
+		Host:           "unix:///var/run/docker.sock",
+		TimeoutInMilli: 5000,
+	}
+}
+
+func (w *WatcherDocker) GetServiceName() string {
+	parts := strings.SplitN(w.Label, "=", 2)
+	return parts[len(parts)-1]
+}
+
+func (w *WatcherDocker) Init(service *Service) error {
+	if err := w.CommonInit(service); err != nil {
+		return errs.WithEF(err, w.fields, "Failed to init discovery")
+	}
+	w.fields = w.fields.WithField("host", w.Host).WithField("label", w.Label)
+
+	if w.Label == "" {
+		return errs.WithF(w.fields, "Label is mandatory for docker watcher")
+	}
+
+	transport := &http.Transport{}
+	if strings.HasPrefix(w.Host, "unix://") {
+		socket := strings.TrimPrefix(w.Host, "unix://")
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			d := net.Dialer{}
+			return d.DialContext(ctx, "unix", socket)
+		}
+		w.baseUrl = "http://docker"
+	} else if strings.HasPrefix(w.Host, "tcp://") {
+		w.baseUrl = "http://" + strings.TrimPrefix(w.Host, "tcp://")
+	} else {
+		return errs.WithF(w.fields, "Unsupported docker host, must be unix:// or tcp://")
+	}
+	w.client = &http.Client{Transport: transport}
+	return nil
+}
+
+func (w *WatcherDocker) Watch(context *ContextImpl, events chan<- ServiceReport, s *Service) {
+	context.doneWaiter.Add(1)
+	defer context.doneWaiter.Done()
+	w.service.synapse.watcherFailures.WithLabelValues(w.service.Name, PrometheusLabelWatch).Set(0)
+
+	reportsStop := make(chan struct{})
+	go w.changedToReport(reportsStop, events, s)
+
+	watcherStop := make(chan struct{})
+	watcherStopWaiter := sync.WaitGroup{}
+	go w.watchContainers(watcherStop, &watcherStopWaiter)
+
+	<-context.stop
+	logs.WithF(w.fields).Debug("Stopping watcher")
+	close(watcherStop)
+	watcherStopWaiter.Wait()
+	close(reportsStop)
+	logs.WithF(w.fields).Debug("Watcher stopped")
+}
+
+func (w *WatcherDocker) watchContainers(stop <-chan struct{}, doneWaiter *sync.WaitGroup) {
+	doneWaiter.Add(1)
+	defer doneWaiter.Done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	for {
+		// events since listing are replayed by docker, so nothing is missed
+		since := time.Now().Unix()
+		err := w.list(ctx)
+		if err == nil {
+			err = w.follow(ctx, since)
+		}
+
+		if isStopped(stop) {
+			return
+		}
+		w.countFailure(err)
+		logs.WithEF(err, w.fields).Warn("Cannot watch docker containers. Retry in 1s")
+		<-time.After(time.Duration(1000) * time.Millisecond)
+
+		if isStopped(stop) {
+			return
+		}
+	}
+}
+
+func (w *WatcherDocker) list(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(w.TimeoutInMilli)*time.Millisecond)
+	defer cancel()
+
+	filters, _ := json.Marshal(map[string][]string{
+		"label":  {w.Label},
+		"status": {"running"},
+	})
+	var containers []struct {
+		Id string
+	}
+	if err := w.get(ctx, "/containers/json?filters="+url.QueryEscape(string(filters)), &containers); err != nil {
+		return err
+	}
+
+	reports := make(map[string]Report)
+	for _, container := range containers {
+		r, ok, err := w.inspect(ctx, container.Id)
+		if err != nil {
+			return err
+		}
+		if ok {
+			reports[container.Id] = r
+		}
+	}
+	w.reports.replaceAll(reports)
+	return nil
+}
+
+func (w *WatcherDocker) follow(ctx context.Context, since int64) error {
+	filters, _ := json.Marshal(map[string][]string{
+		"type":  {"container"},
+		"label": {w.Label},
+		"event": {"start", "stop", "die", "destroy", "pause", "unpause", "health_status"},
+	})
+	u := w.baseUrl + "/events?since=" + strconv.FormatInt(since, 10) + "&filters=" + url.QueryEscape(string(filters))
+	resp, err := w.request(ctx, u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		event := dockerEvent{}
+		if err := decoder.Decode(&event); err != nil {
+			return errs.WithEF(err, w.fields, "Docker events stream interrupted")
+		}
+		fields := w.fields.WithField("container", event.Actor.ID).WithField("action", event.Action)
+		logs.WithF(fields).Debug("Docker event received")
+
+		if event.Action == "destroy" {
+			w.reports.removeNode(event.Actor.ID)
+			continue
+		}
+
+		r, ok, err := w.inspect(ctx, event.Actor.ID)
+		if err != nil {
+			// state of the container is unknown, list again
+			return errs.WithEF(err, fields, "Failed to inspect container")
+		} else if !ok {
+			w.reports.removeNode(event.Actor.ID)
+		} else {
+			w.reports.addReport(event.Actor.ID, r)
+		}
+	}
+}
+
+func (w *WatcherDocker) inspect(ctx context.Context, id string) (Report, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(w.TimeoutInMilli)*time.Millisecond)
+	defer cancel()
+
+	container := dockerContainer{}
+	if err := w.get(ctx, "/containers/"+url.PathEscape(id)+"/json", &container); err != nil {
+		return Report{}, false, err
+	}
+	if !container.State.Running {
+		return Report{}, false, nil
+	}
+	fields := w.fields.WithField("container", container.Name)
+
+	containerPort, ok := w.containerPort(container)
+	if !ok {
+		w.service.synapse.watcherFailures.WithLabelValues(w.service.Name, PrometheusLabelContent).Inc()
+		logs.WithF(fields).Warn("Cannot find container port, set port in watcher")
+		return Report{}, false, nil
+	}
+
+	var host string
+	var port int
+	if w.UsePublishedPort {
+		for _, binding := range container.NetworkSettings.Ports[containerPort] {
+			host = binding.HostIp
+			port, _ = strconv.Atoi(binding.HostPort)
+			break
+		}
+		if host == "" || host == "0.0.0.0" || host == "::" {
+			host = "127.0.0.1"
+		}
+	} else {
+		port, _ = strconv.Atoi(strings.SplitN(containerPort, "/", 2)[0])
+		host = w.containerIp(container)
+	}
+	if host == "" || port == 0 {
+		w.service.synapse.watcherFailures.WithLabelValues(w.service.Name, PrometheusLabelContent).Inc()
+		logs.WithF(fields.WithField("port", containerPort)).Warn("Cannot find container address")
+		return Report{}, false, nil
+	}
+
+	available := true
+	r := nerve.Report{
+		Available: &available,
+		Host:      host,
+		Port:      nerve.Port(port),
+		Name:      strings.TrimPrefix(container.Name, "/"),
+		Labels:    container.Config.Labels,
+	}
+	if container.State.Health != nil && container.State.Health.Status != "healthy" {
+		available = false
+		r.UnavailableReason = "container is " + container.State.Health.Status
+		r.Weight = uint8Ptr(0)
+	}
+	return Report{Report: r, CreationTime: container.Created.UnixNano() / int64(time.Millisecond)}, true, nil
+}
+
+func (w *WatcherDocker) containerIp(container dockerContainer) string {
+	if w.Network != "" {
+		return container.NetworkSettings.Networks[w.Network].IPAddress
+	}
+	if container.NetworkSettings.IPAddress != "" {
+		return container.NetworkSettings.IPAddress
+	}
+	names := []string{}
+	for name := range container.NetworkSettings.Networks {
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	sort.Strings(names)
+	return container.NetworkSettings.Networks[names[0]].IPAddress
+}
+
+func (w *WatcherDocker) containerPort(container dockerContainer) (string, bool) {
+	if w.Port != 0 {
+		return strconv.Itoa(w.Port) + "/tcp", true
+	}
+	if len(container.Config.ExposedPorts) == 1 {
+		for port := range container.Config.ExposedPorts {
+			return port, true
+		}
+	}
+	return "", false
+}
+
+func (w *WatcherDocker) get(ctx context.Context, path string, result interface{}) error {
+	resp, err := w.request(ctx, w.baseUrl+path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return watcherContentError{errs.WithEF(err, w.fields.WithField("path", path), "Failed to read docker response")}
+	}
+	return nil
+}
+
+func (w *WatcherDocker) request(ctx context.Context, u string) (*http.Response, error) {
+	fields := w.fields.WithField("url", u)
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, errs.WithEF(err, fields, "Failed to prepare docker request")
+	}
+	resp, err := w.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errs.WithEF(err, fields, "Docker request failed")
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, errs.WithF(fields.WithField("status", resp.StatusCode), "Bad docker response status")
+	}
+	return resp, nil
+}
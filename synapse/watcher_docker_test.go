@@ -0,0 +1,130 @@
+package synapse
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var dockerTestContainers = map[string]string{
+	"c1": `{"Id": "c1", "Name": "/api-1", "Created": "2020-01-01T00:00:00Z", "State": {"Running": true},
+		"Config": {"Labels": {"service": "api"}, "ExposedPorts": {"8080/tcp": {}}},
+		"NetworkSettings": {"Networks": {"bridge": {"IPAddress": "172.17.0.2"}}}}`,
+	"c2": `{"Id": "c2", "Name": "/api-2", "State": {"Running": true, "Health": {"Status": "starting"}},
+		"Config": {"Labels": {"service": "api"}, "ExposedPorts": {"8080/tcp": {}}},
+		"NetworkSettings": {"IPAddress": "172.17.0.3"}}`,
+	"c3": `{"Id": "c3", "Name": "/api-3", "State": {"Running": true},
+		"Config": {"Labels": {"service": "api"}, "ExposedPorts": {"8080/tcp": {}, "9090/tcp": {}}},
+		"NetworkSettings": {"IPAddress": "172.17.0.4"}}`,
+	"c4": `{"Id": "c4", "Name": "/api-4", "State": {"Running": true},
+		"Config": {"Labels": {"service": "api"}, "ExposedPorts": {"8080/tcp": {}}},
+		"NetworkSettings": {"IPAddress": "172.17.0.5"}}`,
+	"stopped": `{"Id": "stopped", "Name": "/api-stopped", "State": {"Running": false}}`,
+}
+
+const dockerTestEvents = `{"Type": "container", "Action": "die", "Actor": {"ID": "stopped"}}
+{"Type": "container", "Action": "destroy", "Actor": {"ID": "c2"}}
+{"Type": "container", "Action": "start", "Actor": {"ID": "c4"}}
+{"Type": "container", "Action": "start", "Actor": {"ID": "gone"}}
+{"Type": "container", "Action": "stop", "Actor": {"ID": "c1"}}
+`
+
+// docker engine api listing c1, c2 and c3 then streaming events until closed
+func dockerTestServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/containers/json":
+			filters := map[string][]string{}
+			json.Unmarshal([]byte(r.URL.Query().Get("filters")), &filters)
+			if len(filters["label"]) != 1 || filters["label"][0] != "service=api" {
+				t.Errorf("containers should be filtered by label, was %v", filters)
+			}
+			w.Write([]byte(`[{"Id": "c1"}, {"Id": "c2"}, {"Id": "c3"}]`))
+		case strings.HasPrefix(r.URL.Path, "/containers/"):
+			container, ok := dockerTestContainers[strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/containers/"), "/json")]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write([]byte(container))
+		case r.URL.Path == "/events":
+			if r.URL.Query().Get("since") == "" {
+				t.Errorf("events should be followed since listing, was %s", r.URL.RawQuery)
+			}
+			w.Write([]byte(dockerTestEvents))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestWatcherDockerListAndFollow(t *testing.T) {
+	server := dockerTestServer(t)
+	defer server.Close()
+
+	s := &Synapse{}
+	s.Init("version", "buildtime", true)
+	w := NewWatcherDocker()
+	w.Host = "tcp://" + strings.TrimPrefix(server.URL, "http://")
+	w.Label = "service=api"
+	if err := w.Init(&Service{Name: "api", synapse: s}); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for range w.reports.changed {
+		}
+	}()
+
+	if err := w.list(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	w.reports.RLock()
+	if len(w.reports.m) != 2 {
+		t.Errorf("container without single exposed port should be ignored, was %v", w.reports.m)
+	}
+	if r := w.reports.m["c1"]; r.Name != "api-1" || r.Host != "172.17.0.2" || r.Port != 8080 || !*r.Available || r.CreationTime == 0 {
+		t.Errorf("unexpected running container %v", r)
+	}
+	if r := w.reports.m["c2"]; *r.Available || *r.Weight != 0 || r.Host != "172.17.0.3" {
+		t.Errorf("unhealthy container should be unavailable, was %v", r)
+	}
+	w.reports.RUnlock()
+
+	if err := w.follow(context.Background(), 0); err == nil || !strings.Contains(err.Error(), "Failed to inspect container") {
+		t.Errorf("failed inspect should stop following to list again, was %v", err)
+	}
+	w.reports.RLock()
+	defer w.reports.RUnlock()
+	if len(w.reports.m) != 2 || w.reports.m["c4"].Host != "172.17.0.5" {
+		t.Errorf("destroyed container should be removed and started one added, was %v", w.reports.m)
+	}
+	if _, ok := w.reports.m["c1"]; !ok {
+		t.Errorf("running container should be kept, was %v", w.reports.m)
+	}
+}
+
+func TestWatcherDockerInit(t *testing.T) {
+	s := &Synapse{}
+	s.Init("version", "buildtime", true)
+
+	for _, test := range []struct {
+		host  string
+		label string
+		fails bool
+	}{
+		{"unix:///var/run/docker.sock", "service=api", false},
+		{"tcp://127.0.0.1:2375", "service=api", false},
+		{"http://127.0.0.1:2375", "service=api", true},
+		{"unix:///var/run/docker.sock", "", true},
+	} {
+		w := NewWatcherDocker()
+		w.Host = test.host
+		w.Label = test.label
+		if err := w.Init(&Service{Name: "api", synapse: s}); (err != nil) != test.fails {
+			t.Errorf("unexpected init result for %s %s: %v", test.host, test.label, err)
+		}
+	}
+}
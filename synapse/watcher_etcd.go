@@ -0,0 +1,340 @@
+package synapse
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+	"github.com/n0rad/go-erlog/logs"
+)
+
+// talk to etcd v3 through its grpc json gateway
+type WatcherEtcd struct {
+	WatcherCommon
+	Endpoints      []string
+	Prefix         string
+	Username       string
+	Password       string
+	ApiPrefix      string
+	TimeoutInMilli int
+	// without any message on the watch stream, it is considered dead
+	WatchProgressTimeoutInMilli int
+
+	client        *http.Client
+	endpointIndex int
+	token         string
+}
+
+type etcdInt64 int64
+
+func (i *etcdInt64) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(string(b), `"`)
+	if s == "" || s == "null" {
+		*i = 0
+		return nil
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return errs.WithEF(err, data.WithField("content", string(b)), "Invalid etcd integer")
+	}
+	*i = etcdInt64(v)
+	return nil
+}
+
+type etcdHeader struct {
+	Revision etcdInt64 `json:"revision"`
+}
+
+type etcdKeyValue struct {
+	Key            []byte    `json:"key"`
+	Value          []byte    `json:"value"`
+	CreateRevision etcdInt64 `json:"create_revision"`
+	ModRevision    etcdInt64 `json:"mod_revision"`
+	Lease          etcdInt64 `json:"lease"`
+}
+
+type etcdRangeResponse struct {
+	Header etcdHeader     `json:"header"`
+	Kvs    []etcdKeyValue `json:"kvs"`
+}
+
+type etcdWatchResponse struct {
+	Result *struct {
+		Header          etcdHeader `json:"header"`
+		Created         bool       `json:"created"`
+		Canceled        bool       `json:"canceled"`
+		CompactRevision etcdInt64  `json:"compact_revision"`
+		Events          []struct {
+			Type string       `json:"type"`
+			Kv   etcdKeyValue `json:"kv"`
+		} `json:"events"`
+	} `json:"result"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func NewWatcherEtcd() *WatcherEtcd {
+	return &WatcherEtcd{
+		Endpoints:      []string{"http://127.0.0.1:2379"},
+		ApiPrefix:      "/v3",
+		TimeoutInMilli: 5000,
+		// etcd sends progress notifications every 10 minutes by default
+		WatchProgressTimeoutInMilli: 660000,
+	}
+}
+
+func (w *WatcherEtcd) GetServiceName() string {
+	return strings.Replace(strings.Trim(w.Prefix, "/"), "/", "_", -1)
+}
+
+func (w *WatcherEtcd) Init(service *Service) error {
+	if err := w.CommonInit(service); err != nil {
+		return errs.WithEF(err, w.fields, "Failed to init discovery")
+	}
+	w.fields = w.fields.WithField("prefix", w.Prefix)
+
+	if w.Prefix == "" {
+		return errs.WithF(w.fields, "Prefix is mandatory for etcd watcher")
+	}
+	if len(w.Endpoints) == 0 {
+		return errs.WithF(w.fields, "Endpoints are mandatory for etcd watcher")
+	}
+	if w.WatchProgressTimeoutInMilli <= 0 {
+		return errs.WithF(w.fields.WithField("watchProgressTimeoutInMilli", w.WatchProgressTimeoutInMilli), "watchProgressTimeoutInMilli must be positive")
+	}
+	for i, endpoint := range w.Endpoints {
+		if !strings.Contains(endpoint, "://") {
+			endpoint = "http://" + endpoint
+		}
+		w.Endpoints[i] = strings.TrimSuffix(endpoint, "/")
+	}
+	w.ApiPrefix = "/" + strings.Trim(w.ApiPrefix, "/")
+	w.client = &http.Client{}
+	return nil
+}
+
+func (w *WatcherEtcd) Watch(context *ContextImpl, events chan<- ServiceReport, s *Service) {
+	context.doneWaiter.Add(1)
+	defer context.doneWaiter.Done()
+	w.service.synapse.watcherFailures.WithLabelValues(w.service.Name, PrometheusLabelWatch).Set(0)
+
+	reportsStop := make(chan struct{})
+	go w.changedToReport(reportsStop, events, s)
+
+	watcherStop := make(chan struct{})
+	watcherStopWaiter := sync.WaitGroup{}
+	go w.watchPrefix(watcherStop, &watcherStopWaiter)
+
+	<-context.stop
+	logs.WithF(w.fields).Debug("Stopping watcher")
+	close(watcherStop)
+	watcherStopWaiter.Wait()
+	close(reportsStop)
+	logs.WithF(w.fields).Debug("Watcher stopped")
+}
+
+func (w *WatcherEtcd) watchPrefix(stop <-chan struct{}, doneWaiter *sync.WaitGroup) {
+	doneWaiter.Add(1)
+	defer doneWaiter.Done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	for {
+		err := w.authenticate(ctx)
+		if err == nil {
+			var revision int64
+			if revision, err = w.list(ctx); err == nil {
+				err = w.follow(ctx, revision+1)
+			}
+		}
+
+		if isStopped(stop) {
+			return
+		}
+		w.countFailure(err)
+		logs.WithEF(err, w.fields.WithField("endpoint", w.endpoint())).Warn("Cannot watch etcd prefix. Retry in 1s")
+		w.endpointIndex = (w.endpointIndex + 1) % len(w.Endpoints)
+		<-time.After(time.Duration(1000) * time.Millisecond)
+
+		if isStopped(stop) {
+			return
+		}
+	}
+}
+
+func (w *WatcherEtcd) list(ctx context.Context) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(w.TimeoutInMilli)*time.Millisecond)
+	defer cancel()
+
+	resp, err := w.post(ctx, "/kv/range", map[string][]byte{
+		"key":       []byte(w.Prefix),
+		"range_end": etcdPrefixEnd([]byte(w.Prefix)),
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	rangeResponse := etcdRangeResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&rangeResponse); err != nil {
+		return 0, watcherContentError{errs.WithEF(err, w.fields, "Failed to read etcd range response")}
+	}
+
+	reports := make(map[string]Report)
+	for _, kv := range rangeResponse.Kvs {
+		key := string(kv.Key)
+		if r, ok := w.reports.parseRawReport(kv.Value, w.fields.WithField("key", key)); ok {
+			reports[key] = Report{Report: r, CreationTime: int64(kv.CreateRevision)}
+		}
+	}
+	w.reports.replaceAll(reports)
+	return int64(rangeResponse.Header.Revision), nil
+}
+
+func (w *WatcherEtcd) follow(parentCtx context.Context, startRevision int64) error {
+	ctx, cancel := context.WithCancel(parentCtx)
+	defer cancel()
+	progressTimeout := time.Duration(w.WatchProgressTimeoutInMilli) * time.Millisecond
+	progressTimer := time.AfterFunc(progressTimeout, cancel)
+	defer progressTimer.Stop()
+
+	resp, err := w.post(ctx, "/watch", map[string]interface{}{
+		"create_request": map[string]interface{}{
+			"key":             []byte(w.Prefix),
+			"range_end":       etcdPrefixEnd([]byte(w.Prefix)),
+			"start_revision":  strconv.FormatInt(startRevision, 10),
+			"progress_notify": true,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		watchResponse := etcdWatchResponse{}
+		if err := decoder.Decode(&watchResponse); err != nil {
+			if parentCtx.Err() == nil && ctx.Err() != nil {
+				return errs.WithF(w.fields.WithField("timeout", progressTimeout), "No progress on etcd watch stream")
+			}
+			return errs.WithEF(err, w.fields, "etcd watch stream interrupted")
+		}
+		progressTimer.Reset(progressTimeout)
+		if watchResponse.Error != nil {
+			return errs.WithF(w.fields.WithField("message", watchResponse.Error.Message), "etcd watch failed")
+		}
+		result := watchResponse.Result
+		if result == nil {
+			continue
+		}
+		if result.CompactRevision > 0 || result.Canceled {
+			return errs.WithF(w.fields.WithField("compactRevision", result.CompactRevision), "etcd watch canceled, need to list again")
+		}
+		if result.Created {
+			logs.WithF(w.fields.WithField("revision", startRevision)).Debug("etcd watch created")
+		}
+
+		for _, event := range result.Events {
+			key := string(event.Kv.Key)
+			fields := w.fields.WithField("key", key)
+			// PUT is the default enum value so it's omitted from json
+			if event.Type == "DELETE" {
+				logs.WithF(fields).Debug("Key deleted")
+				w.reports.removeNode(key)
+				continue
+			}
+			r, ok := w.reports.parseRawReport(event.Kv.Value, fields)
+			if !ok {
+				// the previous content of the key is outdated
+				w.reports.removeNode(key)
+				continue
+			}
+			w.reports.addReport(key, Report{Report: r, CreationTime: int64(event.Kv.CreateRevision)})
+		}
+	}
+}
+
+func (w *WatcherEtcd) authenticate(ctx context.Context) error {
+	if w.Username == "" {
+		return nil
+	}
+	w.token = ""
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(w.TimeoutInMilli)*time.Millisecond)
+	defer cancel()
+	resp, err := w.post(ctx, "/auth/authenticate", map[string]string{
+		"name":     w.Username,
+		"password": w.Password,
+	})
+	if err != nil {
+		return errs.WithEF(err, w.fields.WithField("username", w.Username), "etcd authentication failed")
+	}
+	defer resp.Body.Close()
+
+	auth := struct {
+		Token string `json:"token"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&auth); err != nil || auth.Token == "" {
+		return errs.WithEF(err, w.fields.WithField("username", w.Username), "Failed to read etcd authentication token")
+	}
+	w.token = auth.Token
+	return nil
+}
+
+func (w *WatcherEtcd) endpoint() string {
+	return w.Endpoints[w.endpointIndex]
+}
+
+func (w *WatcherEtcd) post(ctx context.Context, path string, body interface{}) (*http.Response, error) {
+	url := w.endpoint() + w.ApiPrefix + path
+	fields := w.fields.WithField("url", url)
+
+	content, err := json.Marshal(body)
+	if err != nil {
+		return nil, errs.WithEF(err, fields, "Failed to prepare etcd request")
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(content))
+	if err != nil {
+		return nil, errs.WithEF(err, fields, "Failed to prepare etcd request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if w.token != "" {
+		req.Header.Set("Authorization", w.token)
+	}
+
+	resp, err := w.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errs.WithEF(err, fields, "etcd request failed")
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, errs.WithF(fields.WithField("status", resp.StatusCode), "Bad etcd response status")
+	}
+	return resp, nil
+}
+
+func etcdPrefixEnd(prefix []byte) []byte {
+	end := make([]byte, len(prefix))
+	copy(end, prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	// prefix is only 0xff, watch everything after it
+	return []byte{0}
+}
@@ -0,0 +1,156 @@
+package synapse
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func etcdB64(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+// etcd json gateway answering a range then streaming the given watch responses
+func etcdTestServer(t *testing.T, watchResponses []string, hang bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v3/kv/range":
+			w.Write([]byte(`{"header": {"revision": "41"}, "kvs": [
+				{"key": "` + etcdB64("/services/api/a") + `", "value": "` + etcdB64(`{"host": "10.0.0.1", "port": 80}`) + `", "create_revision": "12"},
+				{"key": "` + etcdB64("/services/api/b") + `", "value": "` + etcdB64(`{"host": "10.0.0.2", "port": 80}`) + `", "create_revision": 13}
+			]}`))
+		case "/v3/watch":
+			request := struct {
+				CreateRequest struct {
+					StartRevision  string `json:"start_revision"`
+					ProgressNotify bool   `json:"progress_notify"`
+				} `json:"create_request"`
+			}{}
+			json.NewDecoder(r.Body).Decode(&request)
+			if request.CreateRequest.StartRevision != "42" || !request.CreateRequest.ProgressNotify {
+				t.Errorf("unexpected watch request %v", request)
+			}
+			for _, response := range watchResponses {
+				w.Write([]byte(response + "\n"))
+			}
+			w.(http.Flusher).Flush()
+			if hang {
+				<-r.Context().Done()
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func etcdTestWatcher(t *testing.T, server *httptest.Server) *WatcherEtcd {
+	s := &Synapse{}
+	s.Init("version", "buildtime", true)
+
+	w := NewWatcherEtcd()
+	w.Endpoints = []string{server.URL}
+	w.Prefix = "/services/api/"
+	w.WatchProgressTimeoutInMilli = 200
+	if err := w.Init(&Service{Name: "api", synapse: s}); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for range w.reports.changed {
+		}
+	}()
+	return w
+}
+
+func TestEtcdInt64(t *testing.T) {
+	for _, test := range []struct {
+		content  string
+		expected etcdInt64
+		fails    bool
+	}{
+		{`"42"`, 42, false},
+		{`42`, 42, false},
+		{`""`, 0, false},
+		{`null`, 0, false},
+		{`"-1"`, -1, false},
+		{`"abc"`, 0, true},
+	} {
+		var i etcdInt64
+		err := json.Unmarshal([]byte(test.content), &i)
+		if (err != nil) != test.fails || i != test.expected {
+			t.Errorf("%s should be %d, was %d %v", test.content, test.expected, i, err)
+		}
+	}
+}
+
+func TestWatcherEtcdListAndFollow(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		stream   []string
+		hang     bool
+		expected []string
+	}{
+		{"compaction", []string{
+			`{"result": {"header": {"revision": "41"}, "created": true}}`,
+			`{"result": {"events": [{"kv": {"key": "` + etcdB64("/services/api/c") + `", "value": "` + etcdB64(`{"host": "10.0.0.3", "port": 80}`) + `", "create_revision": "42"}}]}}`,
+			`{"result": {"events": [{"type": "DELETE", "kv": {"key": "` + etcdB64("/services/api/a") + `"}}]}}`,
+			`{"result": {"compact_revision": "50"}}`,
+		}, false, []string{"/services/api/b", "/services/api/c"}},
+		{"invalid put", []string{
+			`{"result": {"events": [{"kv": {"key": "` + etcdB64("/services/api/a") + `", "value": "` + etcdB64(`{"host": `) + `", "create_revision": "12"}}]}}`,
+			`{"result": {"canceled": true}}`,
+		}, false, []string{"/services/api/b"}},
+		{"canceled", []string{
+			`{"result": {"created": true}}`,
+			`{"result": {"canceled": true}}`,
+		}, false, []string{"/services/api/a", "/services/api/b"}},
+		{"error", []string{
+			`{"error": {"message": "permission denied"}}`,
+		}, false, []string{"/services/api/a", "/services/api/b"}},
+		{"stalled", []string{
+			`{"result": {"created": true}}`,
+		}, true, []string{"/services/api/a", "/services/api/b"}},
+	} {
+		server := etcdTestServer(t, test.stream, test.hang)
+		w := etcdTestWatcher(t, server)
+
+		revision, err := w.list(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if revision != 41 {
+			t.Errorf("%s: unexpected revision %d", test.name, revision)
+		}
+
+		done := make(chan error)
+		go func() {
+			done <- w.follow(context.Background(), revision+1)
+		}()
+		select {
+		case err := <-done:
+			if err == nil {
+				t.Errorf("%s: follow should end with an error", test.name)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: follow should not block", test.name)
+		}
+
+		w.reports.RLock()
+		if len(w.reports.m) != len(test.expected) {
+			t.Errorf("%s: servers should be %v, was %v", test.name, test.expected, w.reports.m)
+		}
+		for _, key := range test.expected {
+			if _, ok := w.reports.m[key]; !ok {
+				t.Errorf("%s: servers should be %v, was %v", test.name, test.expected, w.reports.m)
+			}
+		}
+		if r, ok := w.reports.m["/services/api/b"]; ok && r.CreationTime != 13 {
+			t.Errorf("%s: creation revision should be used, was %d", test.name, r.CreationTime)
+		}
+		w.reports.RUnlock()
+		server.Close()
+	}
+}
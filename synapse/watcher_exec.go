@@ -0,0 +1,305 @@
+package synapse
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+	"github.com/n0rad/go-erlog/logs"
+)
+
+const EXEC_ACTION_ADD = "add"
+const EXEC_ACTION_REMOVE = "remove"
+
+type WatcherExec struct {
+	WatcherCommon
+	Command         []string
+	Env             []string
+	LongRunning     bool
+	IntervalInMilli int
+	TimeoutInMilli  int
+
+	firstSeens firstSeenTimes
+	listed     bool
+	mutex      sync.Mutex
+	process    *os.Process
+}
+
+// a line is either a json array of reports or an event
+type execEvent struct {
+	Action string
+	Name   string
+	Server json.RawMessage
+}
+
+func NewWatcherExec() *WatcherExec {
+	return &WatcherExec{
+		IntervalInMilli: 10000,
+		TimeoutInMilli:  2000,
+	}
+}
+
+func (w *WatcherExec) GetServiceName() string {
+	if len(w.Command) == 0 {
+		return ""
+	}
+	parts := strings.Split(w.Command[0], "/")
+	return parts[len(parts)-1]
+}
+
+func (w *WatcherExec) Init(service *Service) error {
+	if err := w.CommonInit(service); err != nil {
+		return errs.WithEF(err, w.fields, "Failed to init discovery")
+	}
+	w.fields = w.fields.WithField("command", w.Command)
+
+	if len(w.Command) == 0 {
+		return errs.WithF(w.fields, "Command is mandatory for exec watcher")
+	}
+	if !w.LongRunning && w.IntervalInMilli <= 0 {
+		return errs.WithF(w.fields.WithField("intervalInMilli", w.IntervalInMilli), "intervalInMilli must be positive")
+	}
+	w.firstSeens = make(firstSeenTimes)
+	return nil
+}
+
+func (w *WatcherExec) Watch(context *ContextImpl, events chan<- ServiceReport, s *Service) {
+	context.doneWaiter.Add(1)
+	defer context.doneWaiter.Done()
+	w.service.synapse.watcherFailures.WithLabelValues(w.service.Name, PrometheusLabelWatch).Set(0)
+
+	reportsStop := make(chan struct{})
+	go w.changedToReport(reportsStop, events, s)
+
+	watcherStop := make(chan struct{})
+	watcherStopWaiter := sync.WaitGroup{}
+	if w.LongRunning {
+		go w.watchProcess(watcherStop, &watcherStopWaiter)
+	} else {
+		go w.watchPeriodically(watcherStop, &watcherStopWaiter)
+	}
+
+	<-context.stop
+	logs.WithF(w.fields).Debug("Stopping watcher")
+	close(watcherStop)
+	w.mutex.Lock()
+	if w.process != nil {
+		killProcessGroup(w.process)
+	}
+	w.mutex.Unlock()
+	watcherStopWaiter.Wait()
+	close(reportsStop)
+	logs.WithF(w.fields).Debug("Watcher stopped")
+}
+
+func (w *WatcherExec) watchPeriodically(stop <-chan struct{}, doneWaiter *sync.WaitGroup) {
+	doneWaiter.Add(1)
+	defer doneWaiter.Done()
+
+	for {
+		var b bytes.Buffer
+		if err := w.run(&b, w.TimeoutInMilli, stop); err != nil {
+			if isStopped(stop) {
+				return
+			}
+			w.countFailure(err)
+			logs.WithEF(err, w.fields).Warn("Discovery command failed. Keeping previous servers")
+		} else if err := w.processOutput(&b); err != nil {
+			w.countFailure(err)
+			logs.WithEF(err, w.fields).Warn("Failed to read discovery command output")
+		}
+
+		select {
+		case <-time.After(time.Duration(w.IntervalInMilli) * time.Millisecond):
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (w *WatcherExec) watchProcess(stop <-chan struct{}, doneWaiter *sync.WaitGroup) {
+	doneWaiter.Add(1)
+	defer doneWaiter.Done()
+
+	for {
+		reader, writer := io.Pipe()
+		done := make(chan struct{})
+		var runErr error
+		go func() {
+			runErr = w.run(writer, 0, stop)
+			writer.CloseWithError(runErr)
+			close(done)
+		}()
+		if err := w.processOutput(reader); err != nil {
+			if _, ok := err.(watcherContentError); ok {
+				w.countFailure(err)
+			}
+			logs.WithEF(err, w.fields).Warn("Failed to read discovery command output. Killing it")
+			w.mutex.Lock()
+			if w.process != nil {
+				killProcessGroup(w.process)
+			}
+			w.mutex.Unlock()
+		}
+		// the process is not restarted before the previous one is gone
+		reader.Close()
+		<-done
+
+		if isStopped(stop) {
+			return
+		}
+		w.countFailure(runErr)
+		logs.WithF(w.fields).Warn("Discovery command exited. Restart in 1s")
+		<-time.After(time.Duration(1000) * time.Millisecond)
+
+		if isStopped(stop) {
+			return
+		}
+	}
+}
+
+// same as nerve.ExecCommandFull but with the output given to the watcher
+func (w *WatcherExec) run(stdout io.Writer, timeoutInMilli int, stop <-chan struct{}) error {
+	var stderr bytes.Buffer
+	command := exec.Command(w.Command[0], w.Command[1:]...)
+	command.Stdout = stdout
+	command.Stderr = &stderr
+	command.Env = append(os.Environ(), "SYNAPSE_SERVICE="+w.service.Name)
+	command.Env = append(command.Env, w.Env...)
+	// own process group so children are killed with the command
+	command.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	w.mutex.Lock()
+	if isStopped(stop) {
+		w.mutex.Unlock()
+		return errs.WithF(w.fields, "Watcher stopped")
+	}
+	if err := command.Start(); err != nil {
+		w.mutex.Unlock()
+		return errs.WithEF(err, w.fields, "Failed to start command")
+	}
+	w.process = command.Process
+	w.mutex.Unlock()
+
+	var after *errs.EntryError
+	if timeoutInMilli > 0 {
+		timer := time.AfterFunc(time.Duration(timeoutInMilli)*time.Millisecond, func() {
+			fields := w.fields.WithField("timeout", timeoutInMilli)
+			logs.WithF(fields).Debug("Command timeout")
+			w.mutex.Lock()
+			after = errs.WithF(fields, "Exec command timeout")
+			w.mutex.Unlock()
+			killProcessGroup(command.Process)
+		})
+		defer timer.Stop()
+	}
+
+	err := command.Wait()
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.process = nil
+	if err != nil {
+		e := errs.WithEF(err, w.fields.WithField("stderr", stderr.String()), "Command failed")
+		if after != nil {
+			e = e.WithErr(after)
+		}
+		return e
+	}
+	return nil
+}
+
+func (w *WatcherExec) processOutput(output io.Reader) error {
+	scanner := bufio.NewScanner(output)
+	scanner.Buffer(make([]byte, 64*1024), 10*1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if err := w.processLine(line); err != nil {
+			w.service.synapse.watcherFailures.WithLabelValues(w.service.Name, PrometheusLabelContent).Inc()
+			logs.WithEF(err, w.fields.WithField("line", string(line))).Warn("Invalid discovery command output")
+		}
+	}
+	if err := scanner.Err(); err == bufio.ErrTooLong {
+		return watcherContentError{errs.WithEF(err, w.fields, "Failed to read command output")}
+	} else if err != nil {
+		// the command failed, counted by its caller
+		return errs.WithEF(err, w.fields, "Failed to read command output")
+	}
+	return nil
+}
+
+func (w *WatcherExec) processLine(line []byte) error {
+	if line[0] == '[' {
+		var servers []json.RawMessage
+		if err := json.Unmarshal(line, &servers); err != nil {
+			return errs.WithE(err, "Failed to unmarshal servers list")
+		}
+		reports := make(map[string]Report)
+		for _, server := range servers {
+			if r, ok := w.toReport(server); ok {
+				reports[r.Name] = r
+			}
+		}
+		w.firstSeens.retain(reports)
+		if !w.listed || !w.reports.sameAs(reports) {
+			w.listed = true
+			w.reports.replaceAll(reports)
+		}
+		return nil
+	}
+
+	event := execEvent{}
+	if err := json.Unmarshal(line, &event); err != nil {
+		return errs.WithE(err, "Failed to unmarshal event")
+	}
+	switch event.Action {
+	case EXEC_ACTION_ADD:
+		if r, ok := w.toReport(event.Server); ok {
+			w.reports.addReport(r.Name, r)
+		}
+	case EXEC_ACTION_REMOVE:
+		if event.Name == "" {
+			return errs.With("Remove event without name")
+		}
+		delete(w.firstSeens, event.Name)
+		w.reports.removeNode(event.Name)
+	default:
+		return errs.WithF(data.WithField("action", event.Action), "Unknown event action")
+	}
+	return nil
+}
+
+func (w *WatcherExec) toReport(content []byte) (Report, bool) {
+	fields := w.fields.WithField("server", string(content))
+	r, ok := w.reports.parseRawReport(content, fields)
+	if !ok {
+		return Report{}, false
+	}
+	if r.Host == "" {
+		w.service.synapse.watcherFailures.WithLabelValues(w.service.Name, PrometheusLabelContent).Inc()
+		logs.WithF(fields).Warn("Server without host")
+		return Report{}, false
+	}
+	if r.Name == "" {
+		r.Name = r.Host + ":" + strconv.Itoa(int(r.Port))
+	}
+	return Report{Report: r, CreationTime: w.firstSeens.get(r.Name)}, true
+}
+
+func killProcessGroup(process *os.Process) {
+	if err := syscall.Kill(-process.Pid, syscall.SIGKILL); err != nil {
+		process.Kill()
+	}
+}
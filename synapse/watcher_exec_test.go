@@ -0,0 +1,108 @@
+package synapse
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func execTestWatcher(t *testing.T, command ...string) *WatcherExec {
+	s := &Synapse{}
+	s.Init("version", "buildtime", true)
+
+	w := NewWatcherExec()
+	w.Command = command
+	if err := w.Init(&Service{Name: "api", synapse: s}); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for range w.reports.changed {
+		}
+	}()
+	return w
+}
+
+func TestWatcherExecProcessLine(t *testing.T) {
+	w := execTestWatcher(t, "true")
+
+	for _, test := range []struct {
+		line     string
+		fails    bool
+		expected []string
+	}{
+		{`[{"host": "10.0.0.1", "port": 80}, {"name": "b", "host": "10.0.0.2", "port": 80}]`, false, []string{"10.0.0.1:80", "b"}},
+		{`[{"name": "nohost", "port": 80}, {"name": "b", "host": "10.0.0.2", "port": 80}]`, false, []string{"b"}},
+		{`{"action": "add", "server": {"name": "c", "host": "10.0.0.3", "port": 80}}`, false, []string{"b", "c"}},
+		{`{"action": "add", "server": {"name": "d", "port": 80}}`, false, []string{"b", "c"}},
+		{`{"action": "remove", "name": "b"}`, false, []string{"c"}},
+		{`{"action": "remove"}`, true, []string{"c"}},
+		{`{"action": "update", "name": "c"}`, true, []string{"c"}},
+		{`[{"host": `, true, []string{"c"}},
+		{`not json`, true, []string{"c"}},
+		{`[]`, false, []string{}},
+	} {
+		if err := w.processLine([]byte(test.line)); (err != nil) != test.fails {
+			t.Errorf("unexpected result for %s: %v", test.line, err)
+		}
+		w.reports.RLock()
+		names := []string{}
+		for name := range w.reports.m {
+			names = append(names, name)
+		}
+		w.reports.RUnlock()
+		if len(names) != len(test.expected) {
+			t.Errorf("after %s servers should be %v, was %v", test.line, test.expected, names)
+			continue
+		}
+		for _, name := range test.expected {
+			if _, ok := w.reports.m[name]; !ok {
+				t.Errorf("after %s servers should be %v, was %v", test.line, test.expected, names)
+			}
+		}
+	}
+}
+
+func TestWatcherExecKillOnOutputError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "synapse-exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pids := filepath.Join(dir, "pids")
+
+	// a line bigger than the scanner buffer, then hang
+	w := execTestWatcher(t, "sh", "-c", "echo $$ >> "+pids+"; head -c 11000000 /dev/zero; sleep 60")
+	w.LongRunning = true
+	stop := make(chan struct{})
+	waiter := sync.WaitGroup{}
+	go w.watchProcess(stop, &waiter)
+	defer func() {
+		close(stop)
+		w.mutex.Lock()
+		if w.process != nil {
+			killProcessGroup(w.process)
+		}
+		w.mutex.Unlock()
+		waiter.Wait()
+	}()
+
+	var started []string
+	for i := 0; i < 50 && len(started) < 2; i++ {
+		time.Sleep(100 * time.Millisecond)
+		content, _ := ioutil.ReadFile(pids)
+		started = strings.Fields(string(content))
+	}
+	if len(started) < 2 {
+		t.Fatalf("command should be restarted, was %v", started)
+	}
+	pid, _ := strconv.Atoi(started[0])
+	if err := syscall.Kill(pid, 0); err != syscall.ESRCH {
+		t.Errorf("first process should be killed before restart, was %v", err)
+	}
+}
@@ -0,0 +1,159 @@
+package synapse
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/n0rad/go-erlog/errs"
+	"github.com/n0rad/go-erlog/logs"
+)
+
+type WatcherFile struct {
+	WatcherCommon
+	Path                 string
+	CheckIntervalInMilli int
+
+	modTimes map[string]time.Time
+}
+
+func NewWatcherFile() *WatcherFile {
+	return &WatcherFile{
+		CheckIntervalInMilli: 1000,
+	}
+}
+
+func (w *WatcherFile) GetServiceName() string {
+	return filepath.Base(w.Path)
+}
+
+func (w *WatcherFile) Init(service *Service) error {
+	if err := w.CommonInit(service); err != nil {
+		return errs.WithEF(err, w.fields, "Failed to init discovery")
+	}
+	w.fields = w.fields.WithField("path", w.Path)
+
+	if w.Path == "" {
+		return errs.WithF(w.fields, "Path is mandatory for file watcher")
+	}
+	if w.CheckIntervalInMilli <= 0 {
+		return errs.WithF(w.fields.WithField("checkIntervalInMilli", w.CheckIntervalInMilli), "checkIntervalInMilli must be positive")
+	}
+	w.modTimes = make(map[string]time.Time)
+	return nil
+}
+
+func (w *WatcherFile) Watch(context *ContextImpl, events chan<- ServiceReport, s *Service) {
+	context.doneWaiter.Add(1)
+	defer context.doneWaiter.Done()
+	w.service.synapse.watcherFailures.WithLabelValues(w.service.Name, PrometheusLabelWatch).Set(0)
+
+	reportsStop := make(chan struct{})
+	go w.changedToReport(reportsStop, events, s)
+
+	watcherStop := make(chan struct{})
+	watcherStopWaiter := sync.WaitGroup{}
+	go w.watchDirectory(watcherStop, &watcherStopWaiter)
+
+	<-context.stop
+	logs.WithF(w.fields).Debug("Stopping watcher")
+	close(watcherStop)
+	watcherStopWaiter.Wait()
+	close(reportsStop)
+	logs.WithF(w.fields).Debug("Watcher stopped")
+}
+
+func (w *WatcherFile) watchDirectory(stop <-chan struct{}, doneWaiter *sync.WaitGroup) {
+	doneWaiter.Add(1)
+	defer doneWaiter.Done()
+
+	first := true
+	for {
+		if err := w.scanDirectory(first); err != nil {
+			w.countFailure(err)
+			logs.WithEF(err, w.fields).Warn("Cannot scan reports directory")
+		} else {
+			first = false
+		}
+
+		select {
+		case <-time.After(time.Duration(w.CheckIntervalInMilli) * time.Millisecond):
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (w *WatcherFile) scanDirectory(first bool) error {
+	files, err := ioutil.ReadDir(w.Path)
+	if err != nil {
+		return errs.WithEF(err, w.fields, "Failed to read directory")
+	}
+
+	seen := make(map[string]struct{})
+	for _, file := range files {
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		node := filepath.Join(w.Path, file.Name())
+		seen[node] = struct{}{}
+
+		if modTime, ok := w.modTimes[node]; ok && modTime.Equal(file.ModTime()) {
+			continue
+		}
+		w.modTimes[node] = file.ModTime()
+
+		fields := w.fields.WithField("node", node)
+		content, err := ioutil.ReadFile(node)
+		if err != nil {
+			if os.IsNotExist(err) {
+				delete(seen, node)
+				continue
+			}
+			w.countFailure(err)
+			logs.WithEF(err, fields).Warn("Failed to read report file")
+			delete(w.modTimes, node)
+			continue
+		}
+
+		// nerve's file reporter truncates the file when the server is not available
+		if len(strings.TrimSpace(string(content))) == 0 {
+			if _, ok := w.reports.get(node); ok {
+				logs.WithF(fields).Debug("Report file emptied")
+				w.reports.removeNode(node)
+			}
+			continue
+		}
+
+		r, ok := w.reports.parseRawReport(content, fields)
+		if !ok {
+			// a partial write changes the modification time again when completed
+			if _, ok := w.reports.get(node); ok {
+				w.reports.removeNode(node)
+			}
+			continue
+		}
+		logs.WithF(fields).Debug("Report file changed")
+		modTime := file.ModTime().UnixNano() / int64(time.Millisecond)
+		w.reports.addReport(node, Report{Report: r, CreationTime: modTime, ModificationTime: modTime})
+	}
+
+	for node := range w.modTimes {
+		if _, ok := seen[node]; ok {
+			continue
+		}
+		delete(w.modTimes, node)
+		if _, ok := w.reports.get(node); ok {
+			logs.WithF(w.fields.WithField("node", node)).Debug("Report file removed")
+			w.reports.removeNode(node)
+		}
+	}
+
+	if first && len(w.reports.getValues()) == 0 {
+		w.reports.setNoNodes()
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package synapse
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// watcher_failure is registered once for all tests, so only deltas are meaningful
+func watcherFailureCount(s *Synapse, service string, label string) float64 {
+	metric := dto.Metric{}
+	s.watcherFailures.WithLabelValues(service, label).Write(&metric)
+	return metric.GetGauge().GetValue()
+}
+
+func TestWatcherFileScanDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "synapse-watcher-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := &Synapse{}
+	s.Init("version", "buildtime", true)
+
+	w := NewWatcherFile()
+	w.Path = dir
+	if err := w.Init(&Service{Name: "ServiceA", synapse: s}); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-w.reports.changed:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	ioutil.WriteFile(filepath.Join(dir, "nodeA"), []byte(`{"available":true,"host":"10.0.0.1","port":8080,"name":"nodeA"}`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "nodeB"), []byte(`{"available":true,"host":"10.0.0.2","port":8080,"name":"nodeB"}`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "broken"), []byte(`{not json`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, ".tmp"), []byte(`{"available":true}`), 0644)
+
+	if err := w.scanDirectory(true); err != nil {
+		t.Fatal(err)
+	}
+	if l := len(w.reports.getValues()); l != 2 {
+		t.Errorf("should have 2 reports, was %d", l)
+	}
+	report, ok := w.reports.get(filepath.Join(dir, "nodeA"))
+	if !ok || report.Host != "10.0.0.1" || report.CreationTime == 0 {
+		t.Errorf("nodeA should be reported with a creation time, was %v", report)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "nodeA"), []byte(`{"available":true,"host":`), 0644)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(filepath.Join(dir, "nodeA"), later, later)
+	if err := w.scanDirectory(false); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := w.reports.get(filepath.Join(dir, "nodeA")); ok {
+		t.Error("unparseable nodeA should not keep its previous report")
+	}
+	failures := watcherFailureCount(s, "ServiceA", PrometheusLabelContent)
+	if err := w.scanDirectory(false); err != nil {
+		t.Fatal(err)
+	}
+	if watcherFailureCount(s, "ServiceA", PrometheusLabelContent) != failures {
+		t.Error("unmodified unparseable nodeA should not be read again")
+	}
+	ioutil.WriteFile(filepath.Join(dir, "nodeA"), []byte(`{"available":true,"host":"10.0.0.3","port":8080,"name":"nodeA"}`), 0644)
+	completed := later.Add(time.Second)
+	os.Chtimes(filepath.Join(dir, "nodeA"), completed, completed)
+	if err := w.scanDirectory(false); err != nil {
+		t.Fatal(err)
+	}
+	if report, ok := w.reports.get(filepath.Join(dir, "nodeA")); !ok || report.Host != "10.0.0.3" {
+		t.Errorf("nodeA should be read again once modified, was %v", report)
+	}
+
+	os.Remove(filepath.Join(dir, "nodeA"))
+	ioutil.WriteFile(filepath.Join(dir, "nodeB"), []byte{}, 0644)
+	os.Chtimes(filepath.Join(dir, "nodeB"), later, later)
+	if err := w.scanDirectory(false); err != nil {
+		t.Fatal(err)
+	}
+	if l := len(w.reports.getValues()); l != 0 {
+		t.Errorf("should have no reports, was %d", l)
+	}
+}
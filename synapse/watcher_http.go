@@ -0,0 +1,259 @@
+package synapse
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+	"github.com/n0rad/go-erlog/logs"
+)
+
+type WatcherHttp struct {
+	WatcherCommon
+	Url               string
+	Headers           map[string]string
+	IntervalInMilli   int
+	TimeoutInMilli    int
+	MaxBackoffInMilli int
+	ServersPath       string
+	Mapping           HttpFieldMapping
+
+	client *http.Client
+	etag   string
+	// creation time when not mapped
+	firstSeens firstSeenTimes
+}
+
+// dot separated path of each report field inside a server json object
+type HttpFieldMapping struct {
+	Name                 string
+	Host                 string
+	Port                 string
+	Weight               string
+	Available            string
+	UnavailableReason    string
+	HaProxyServerOptions string
+	Labels               string
+	CreationTime         string
+}
+
+func NewWatcherHttp() *WatcherHttp {
+	return &WatcherHttp{
+		IntervalInMilli:   5000,
+		TimeoutInMilli:    2000,
+		MaxBackoffInMilli: 60000,
+		Mapping: HttpFieldMapping{
+			Name:                 "name",
+			Host:                 "host",
+			Port:                 "port",
+			Weight:               "weight",
+			Available:            "available",
+			UnavailableReason:    "unavailable_reason",
+			HaProxyServerOptions: "haproxy_server_options",
+			Labels:               "labels",
+		},
+	}
+}
+
+func (w *WatcherHttp) GetServiceName() string {
+	parts := strings.Split(strings.TrimSuffix(w.Url, "/"), "/")
+	return parts[len(parts)-1]
+}
+
+func (w *WatcherHttp) Init(service *Service) error {
+	if err := w.CommonInit(service); err != nil {
+		return errs.WithEF(err, w.fields, "Failed to init discovery")
+	}
+	w.fields = w.fields.WithField("url", w.Url)
+
+	if w.Url == "" {
+		return errs.WithF(w.fields, "Url is mandatory for http watcher")
+	}
+	if w.IntervalInMilli <= 0 {
+		return errs.WithF(w.fields.WithField("intervalInMilli", w.IntervalInMilli), "intervalInMilli must be positive")
+	}
+	if w.MaxBackoffInMilli < w.IntervalInMilli {
+		w.MaxBackoffInMilli = w.IntervalInMilli
+	}
+	if w.Mapping.Host == "" || w.Mapping.Port == "" {
+		return errs.WithF(w.fields.WithField("mapping", w.Mapping), "host and port mapping are mandatory")
+	}
+
+	w.client = &http.Client{Timeout: time.Duration(w.TimeoutInMilli) * time.Millisecond}
+	w.firstSeens = make(firstSeenTimes)
+	return nil
+}
+
+func (w *WatcherHttp) Watch(context *ContextImpl, events chan<- ServiceReport, s *Service) {
+	context.doneWaiter.Add(1)
+	defer context.doneWaiter.Done()
+	w.service.synapse.watcherFailures.WithLabelValues(w.service.Name, PrometheusLabelWatch).Set(0)
+
+	reportsStop := make(chan struct{})
+	go w.changedToReport(reportsStop, events, s)
+
+	watcherStop := make(chan struct{})
+	watcherStopWaiter := sync.WaitGroup{}
+	go w.watchUrl(watcherStop, &watcherStopWaiter)
+
+	<-context.stop
+	logs.WithF(w.fields).Debug("Stopping watcher")
+	close(watcherStop)
+	watcherStopWaiter.Wait()
+	close(reportsStop)
+	logs.WithF(w.fields).Debug("Watcher stopped")
+}
+
+func (w *WatcherHttp) watchUrl(stop <-chan struct{}, doneWaiter *sync.WaitGroup) {
+	doneWaiter.Add(1)
+	defer doneWaiter.Done()
+
+	first := true
+	wait := w.IntervalInMilli
+	for {
+		reports, modified, err := w.poll()
+		if err != nil {
+			w.countFailure(err)
+			wait *= 2
+			if wait > w.MaxBackoffInMilli {
+				wait = w.MaxBackoffInMilli
+			}
+			logs.WithEF(err, w.fields.WithField("retryInMilli", wait)).Warn("Failed to poll servers. Keeping previous servers")
+		} else {
+			wait = w.IntervalInMilli
+			if modified && (first || !w.reports.sameAs(reports)) {
+				first = false
+				w.reports.replaceAll(reports)
+			}
+		}
+
+		select {
+		case <-time.After(time.Duration(wait) * time.Millisecond):
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (w *WatcherHttp) poll() (map[string]Report, bool, error) {
+	req, err := http.NewRequest(http.MethodGet, w.Url, nil)
+	if err != nil {
+		return nil, false, errs.WithEF(err, w.fields, "Failed to prepare request")
+	}
+	for k, v := range w.Headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Accept", "application/json")
+	if w.etag != "" {
+		req.Header.Set("If-None-Match", w.etag)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return nil, false, errs.WithEF(err, w.fields, "Request failed")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		logs.WithF(w.fields.WithField("etag", w.etag)).Trace("Servers not modified")
+		return nil, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, errs.WithF(w.fields.WithField("status", resp.StatusCode), "Bad response status")
+	}
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, false, errs.WithEF(err, w.fields, "Failed to read response")
+	}
+	reports, err := w.toReports(content)
+	if err != nil {
+		return nil, false, watcherContentError{err}
+	}
+	w.etag = resp.Header.Get("ETag")
+	return reports, true, nil
+}
+
+func (w *WatcherHttp) toReports(content []byte) (map[string]Report, error) {
+	var root interface{}
+	if err := json.Unmarshal(content, &root); err != nil {
+		return nil, errs.WithEF(err, w.fields.WithField("content", string(content)), "Failed to unmarshal response")
+	}
+	servers, ok := jsonPath(root, w.ServersPath).([]interface{})
+	if !ok {
+		return nil, errs.WithF(w.fields.WithField("serversPath", w.ServersPath), "No servers array found in response")
+	}
+
+	reports := make(map[string]Report)
+	for _, server := range servers {
+		mapped := make(map[string]interface{})
+		for field, path := range map[string]string{
+			"name":                   w.Mapping.Name,
+			"host":                   w.Mapping.Host,
+			"port":                   w.Mapping.Port,
+			"weight":                 w.Mapping.Weight,
+			"available":              w.Mapping.Available,
+			"unavailable_reason":     w.Mapping.UnavailableReason,
+			"haproxy_server_options": w.Mapping.HaProxyServerOptions,
+			"labels":                 w.Mapping.Labels,
+		} {
+			if path == "" {
+				continue
+			}
+			if value := jsonPath(server, path); value != nil {
+				mapped[field] = value
+			}
+		}
+
+		raw, err := json.Marshal(mapped)
+		if err != nil {
+			return nil, errs.WithEF(err, w.fields.WithField("server", server), "Failed to map server")
+		}
+		fields := w.fields.WithField("server", string(raw))
+		r, ok := w.reports.parseRawReport(raw, fields)
+		if !ok {
+			continue
+		}
+		if r.Host == "" || r.Port == 0 {
+			w.service.synapse.watcherFailures.WithLabelValues(w.service.Name, PrometheusLabelContent).Inc()
+			logs.WithF(fields).Warn("Server without host or port")
+			continue
+		}
+		if r.Name == "" {
+			r.Name = r.Host + ":" + strconv.Itoa(int(r.Port))
+		}
+
+		var creationTime int64
+		if w.Mapping.CreationTime != "" {
+			if value, ok := jsonPath(server, w.Mapping.CreationTime).(float64); ok {
+				creationTime = int64(value)
+			}
+		} else {
+			creationTime = w.firstSeens.get(r.Name)
+		}
+		reports[r.Name] = Report{Report: r, CreationTime: creationTime}
+	}
+	w.firstSeens.retain(reports)
+	return reports, nil
+}
+
+func jsonPath(value interface{}, path string) interface{} {
+	if path == "" {
+		return value
+	}
+	for _, key := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			logs.WithF(data.WithField("path", path)).Trace("Path not found in json")
+			return nil
+		}
+		value = object[key]
+	}
+	return value
+}
@@ -0,0 +1,59 @@
+package synapse
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWatcherHttpPoll(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(`{"data": {"instances": [
+			{"id": "i-1", "address": {"ip": "10.0.0.1", "port": "8080"}, "healthy": true, "tags": {"zone": "a"}, "created": 1500},
+			{"id": "i-2", "address": {"ip": "10.0.0.2", "port": 8080}, "healthy": false},
+			{"id": "i-3", "address": {"ip": "10.0.0.3"}}
+		]}}`))
+	}))
+	defer server.Close()
+
+	s := &Synapse{}
+	s.Init("version", "buildtime", true)
+
+	w := NewWatcherHttp()
+	w.Url = server.URL
+	w.ServersPath = "data.instances"
+	w.Mapping = HttpFieldMapping{
+		Name:         "id",
+		Host:         "address.ip",
+		Port:         "address.port",
+		Available:    "healthy",
+		Labels:       "tags",
+		CreationTime: "created",
+	}
+	if err := w.Init(&Service{Name: "ServiceA", synapse: s}); err != nil {
+		t.Fatal(err)
+	}
+
+	reports, modified, err := w.poll()
+	if err != nil || !modified {
+		t.Fatalf("First poll should succeed, was %v %v", modified, err)
+	}
+	if len(reports) != 2 {
+		t.Fatalf("should have 2 reports, was %v", reports)
+	}
+	if r := reports["i-1"]; r.Host != "10.0.0.1" || r.Port != 8080 || !*r.Available || r.Labels["zone"] != "a" || r.CreationTime != 1500 {
+		t.Errorf("Unexpected mapping for i-1: %v %v", r, r.Labels)
+	}
+	if r := reports["i-2"]; *r.Available || *r.Weight != 0 {
+		t.Errorf("i-2 should be unavailable, was %v", r)
+	}
+
+	if _, modified, err := w.poll(); err != nil || modified {
+		t.Errorf("Second poll should not be modified, was %v %v", modified, err)
+	}
+}
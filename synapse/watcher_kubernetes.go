@@ -0,0 +1,357 @@
+package synapse
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blablacar/go-nerve/nerve"
+	"github.com/n0rad/go-erlog/errs"
+	"github.com/n0rad/go-erlog/logs"
+)
+
+const kubernetesServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount/"
+
+type WatcherKubernetes struct {
+	WatcherCommon
+	ApiServer          string
+	Namespace          string
+	Service            string
+	PortName           string
+	Token              string
+	TokenFile          string
+	CaFile             string
+	InsecureSkipVerify bool
+	TimeoutInMilli     int
+
+	client *http.Client
+	slices map[string]kubernetesEndpointSlice
+}
+
+type kubernetesEndpointSlice struct {
+	Metadata struct {
+		Name              string
+		ResourceVersion   string
+		CreationTimestamp time.Time
+	}
+	AddressType string
+	Endpoints   []struct {
+		Addresses  []string
+		Conditions struct {
+			Ready       *bool
+			Terminating *bool
+		}
+		Hostname  string
+		NodeName  string
+		Zone      string
+		TargetRef *struct {
+			Kind string
+			Name string
+		}
+	}
+	Ports []struct {
+		Name string
+		Port *int
+	}
+}
+
+type kubernetesEndpointSliceList struct {
+	Metadata struct {
+		ResourceVersion string
+	}
+	Items []kubernetesEndpointSlice
+}
+
+type kubernetesWatchEvent struct {
+	Type   string
+	Object json.RawMessage
+}
+
+func NewWatcherKubernetes() *WatcherKubernetes {
+	return &WatcherKubernetes{
+		TimeoutInMilli: 5000,
+	}
+}
+
+func (w *WatcherKubernetes) GetServiceName() string {
+	return w.Namespace + "_" + w.Service
+}
+
+func (w *WatcherKubernetes) Init(service *Service) error {
+	if err := w.CommonInit(service); err != nil {
+		return errs.WithEF(err, w.fields, "Failed to init discovery")
+	}
+
+	if w.Service == "" {
+		return errs.WithF(w.fields, "Service is mandatory for kubernetes watcher")
+	}
+
+	// default to in-cluster configuration
+	if w.ApiServer == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return errs.WithF(w.fields, "ApiServer is mandatory when not running in kubernetes")
+		}
+		w.ApiServer = "https://" + net.JoinHostPort(host, port)
+		if w.Token == "" && w.TokenFile == "" {
+			w.TokenFile = kubernetesServiceAccountDir + "token"
+		}
+		if w.CaFile == "" {
+			w.CaFile = kubernetesServiceAccountDir + "ca.crt"
+		}
+	}
+	w.ApiServer = strings.TrimSuffix(w.ApiServer, "/")
+	if w.Namespace == "" {
+		w.Namespace = "default"
+		if content, err := ioutil.ReadFile(kubernetesServiceAccountDir + "namespace"); err == nil {
+			w.Namespace = strings.TrimSpace(string(content))
+		}
+	}
+	w.fields = w.fields.WithField("apiServer", w.ApiServer).WithField("namespace", w.Namespace).WithField("service", w.Service)
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: w.InsecureSkipVerify}
+	if w.CaFile != "" {
+		ca, err := ioutil.ReadFile(w.CaFile)
+		if err != nil {
+			return errs.WithEF(err, w.fields.WithField("file", w.CaFile), "Failed to read kubernetes CA file")
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return errs.WithF(w.fields.WithField("file", w.CaFile), "No certificate found in kubernetes CA file")
+		}
+	}
+	w.client = &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			TLSClientConfig:       tlsConfig,
+			TLSHandshakeTimeout:   time.Duration(w.TimeoutInMilli) * time.Millisecond,
+			ResponseHeaderTimeout: time.Duration(w.TimeoutInMilli) * time.Millisecond,
+		},
+	}
+	return nil
+}
+
+func (w *WatcherKubernetes) Watch(context *ContextImpl, events chan<- ServiceReport, s *Service) {
+	context.doneWaiter.Add(1)
+	defer context.doneWaiter.Done()
+	w.service.synapse.watcherFailures.WithLabelValues(w.service.Name, PrometheusLabelWatch).Set(0)
+
+	reportsStop := make(chan struct{})
+	go w.changedToReport(reportsStop, events, s)
+
+	watcherStop := make(chan struct{})
+	watcherStopWaiter := sync.WaitGroup{}
+	go w.watchSlices(watcherStop, &watcherStopWaiter)
+
+	<-context.stop
+	logs.WithF(w.fields).Debug("Stopping watcher")
+	close(watcherStop)
+	watcherStopWaiter.Wait()
+	close(reportsStop)
+	logs.WithF(w.fields).Debug("Watcher stopped")
+}
+
+func (w *WatcherKubernetes) watchSlices(stop <-chan struct{}, doneWaiter *sync.WaitGroup) {
+	doneWaiter.Add(1)
+	defer doneWaiter.Done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	for {
+		resourceVersion, err := w.list(ctx)
+		if err == nil {
+			err = w.follow(ctx, resourceVersion)
+		}
+
+		if isStopped(stop) {
+			return
+		}
+		if err != nil {
+			w.countFailure(err)
+			logs.WithEF(err, w.fields).Warn("Cannot watch endpointSlices. Retry in 1s")
+			<-time.After(time.Duration(1000) * time.Millisecond)
+
+			if isStopped(stop) {
+				return
+			}
+		}
+	}
+}
+
+func (w *WatcherKubernetes) list(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(w.TimeoutInMilli)*time.Millisecond)
+	defer cancel()
+
+	resp, err := w.get(ctx, url.Values{})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	list := kubernetesEndpointSliceList{}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return "", watcherContentError{errs.WithEF(err, w.fields, "Failed to read endpointSlices list")}
+	}
+
+	w.slices = make(map[string]kubernetesEndpointSlice)
+	for _, slice := range list.Items {
+		w.slices[slice.Metadata.Name] = slice
+	}
+	w.reports.replaceAll(w.toReports())
+	return list.Metadata.ResourceVersion, nil
+}
+
+// return nil when the watch ended normally and a new list is needed, an error when the stream is broken
+func (w *WatcherKubernetes) follow(ctx context.Context, resourceVersion string) error {
+	params := url.Values{}
+	params.Set("watch", "true")
+	params.Set("resourceVersion", resourceVersion)
+	params.Set("allowWatchBookmarks", "true")
+	resp, err := w.get(ctx, params)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		event := kubernetesWatchEvent{}
+		if err := decoder.Decode(&event); err == io.EOF {
+			logs.WithF(w.fields).Debug("endpointSlices watch stream closed")
+			return nil
+		} else if err != nil {
+			return errs.WithEF(err, w.fields, "Failed to read endpointSlices watch stream")
+		}
+
+		switch event.Type {
+		case "ADDED", "MODIFIED", "DELETED":
+			slice := kubernetesEndpointSlice{}
+			if err := json.Unmarshal(event.Object, &slice); err != nil {
+				w.service.synapse.watcherFailures.WithLabelValues(w.service.Name, PrometheusLabelContent).Inc()
+				logs.WithEF(err, w.fields.WithField("content", string(event.Object))).Warn("Failed to unmarshal endpointSlice")
+				continue
+			}
+			logs.WithF(w.fields.WithField("slice", slice.Metadata.Name).WithField("event", event.Type)).Debug("endpointSlice changed")
+			if event.Type == "DELETED" {
+				delete(w.slices, slice.Metadata.Name)
+			} else {
+				w.slices[slice.Metadata.Name] = slice
+			}
+			w.reports.replaceAll(w.toReports())
+		case "BOOKMARK":
+		case "ERROR":
+			// mostly 410 Gone when resourceVersion is too old
+			return errs.WithF(w.fields.WithField("status", string(event.Object)), "endpointSlices watch failed")
+		}
+	}
+}
+
+func (w *WatcherKubernetes) get(ctx context.Context, params url.Values) (*http.Response, error) {
+	params.Set("labelSelector", "kubernetes.io/service-name="+w.Service)
+	u := w.ApiServer + "/apis/discovery.k8s.io/v1/namespaces/" + url.PathEscape(w.Namespace) + "/endpointslices?" + params.Encode()
+	fields := w.fields.WithField("url", u)
+
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, errs.WithEF(err, fields, "Failed to prepare kubernetes request")
+	}
+	token := w.Token
+	if w.TokenFile != "" {
+		// tokens are rotated, read it on each connection
+		content, err := ioutil.ReadFile(w.TokenFile)
+		if err != nil {
+			return nil, errs.WithEF(err, fields.WithField("file", w.TokenFile), "Failed to read kubernetes token file")
+		}
+		token = strings.TrimSpace(string(content))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := w.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errs.WithEF(err, fields, "Kubernetes request failed")
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, errs.WithF(fields.WithField("status", resp.StatusCode), "Bad kubernetes response status")
+	}
+	return resp, nil
+}
+
+func (w *WatcherKubernetes) toReports() map[string]Report {
+	reports := make(map[string]Report)
+	for _, slice := range w.slices {
+		if slice.AddressType == "FQDN" {
+			continue
+		}
+		port, ok := w.slicePort(slice)
+		if !ok {
+			logs.WithF(w.fields.WithField("slice", slice.Metadata.Name).WithField("portName", w.PortName)).Warn("No matching port in endpointSlice")
+			continue
+		}
+
+		for _, endpoint := range slice.Endpoints {
+			if len(endpoint.Addresses) == 0 {
+				continue
+			}
+			// nil ready condition means ready
+			available := endpoint.Conditions.Ready == nil || *endpoint.Conditions.Ready
+			r := nerve.Report{
+				Available: &available,
+				Host:      endpoint.Addresses[0],
+				Port:      nerve.Port(port),
+				Labels:    make(map[string]string),
+			}
+			if endpoint.TargetRef != nil && endpoint.TargetRef.Name != "" {
+				r.Name = endpoint.TargetRef.Name
+			} else {
+				r.Name = endpoint.Addresses[0]
+			}
+			r.Name += "_" + strconv.Itoa(port)
+			if !available {
+				r.UnavailableReason = "endpoint not ready"
+				r.Weight = uint8Ptr(0)
+			}
+			if endpoint.Zone != "" {
+				r.Labels["zone"] = endpoint.Zone
+			}
+			if endpoint.NodeName != "" {
+				r.Labels["node"] = endpoint.NodeName
+			}
+			if endpoint.Conditions.Terminating != nil && *endpoint.Conditions.Terminating {
+				r.Labels["terminating"] = "true"
+			}
+			reports[r.Name] = Report{Report: r, CreationTime: slice.Metadata.CreationTimestamp.UnixNano() / int64(time.Millisecond)}
+		}
+	}
+	return reports
+}
+
+func (w *WatcherKubernetes) slicePort(slice kubernetesEndpointSlice) (int, bool) {
+	for _, port := range slice.Ports {
+		if port.Port == nil {
+			continue
+		}
+		if port.Name == w.PortName || (w.PortName == "" && len(slice.Ports) == 1) {
+			return *port.Port, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,112 @@
+package synapse
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const kubernetesSliceList = `{
+  "metadata": {"resourceVersion": "10"},
+  "items": [{
+    "metadata": {"name": "api-abc", "creationTimestamp": "2020-01-01T00:00:00Z"},
+    "addressType": "IPv4",
+    "endpoints": [
+      {"addresses": ["10.0.0.1"], "conditions": {"ready": true}, "nodeName": "node1", "zone": "a", "targetRef": {"kind": "Pod", "name": "api-1"}},
+      {"addresses": ["10.0.0.2"], "conditions": {"ready": false, "terminating": true}, "targetRef": {"kind": "Pod", "name": "api-2"}}
+    ],
+    "ports": [{"name": "http", "port": 8080}]
+  }]
+}`
+
+const kubernetesSliceEvents = `{"type": "MODIFIED", "object": {
+  "metadata": {"name": "api-abc"},
+  "addressType": "IPv4",
+  "endpoints": [{"addresses": ["10.0.0.3"], "targetRef": {"kind": "Pod", "name": "api-3"}}],
+  "ports": [{"name": "http", "port": 8080}]
+}}
+{"type": "BOOKMARK", "object": {"metadata": {"resourceVersion": "12"}}}
+`
+
+func kubernetesTestServer(t *testing.T, watchBody string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/apis/discovery.k8s.io/v1/namespaces/prod/endpointslices" ||
+			r.URL.Query().Get("labelSelector") != "kubernetes.io/service-name=api" ||
+			r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.URL.Query().Get("watch") != "true" {
+			w.Write([]byte(kubernetesSliceList))
+			return
+		}
+		if r.URL.Query().Get("resourceVersion") != "10" {
+			t.Errorf("watch should start at list resourceVersion, was %s", r.URL.RawQuery)
+		}
+		w.Write([]byte(watchBody))
+	}))
+}
+
+func kubernetesTestWatcher(t *testing.T, server *httptest.Server) *WatcherKubernetes {
+	s := &Synapse{}
+	s.Init("version", "buildtime", true)
+
+	w := NewWatcherKubernetes()
+	w.ApiServer = server.URL
+	w.Namespace = "prod"
+	w.Service = "api"
+	w.PortName = "http"
+	w.Token = "secret"
+	if err := w.Init(&Service{Name: "api", synapse: s}); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for range w.reports.changed {
+		}
+	}()
+	return w
+}
+
+func TestWatcherKubernetesListAndFollow(t *testing.T) {
+	server := kubernetesTestServer(t, kubernetesSliceEvents)
+	defer server.Close()
+	w := kubernetesTestWatcher(t, server)
+
+	resourceVersion, err := w.list(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reports := w.toReports()
+	if resourceVersion != "10" || len(reports) != 2 {
+		t.Fatalf("unexpected list %s %v", resourceVersion, reports)
+	}
+	if r := reports["api-1_8080"]; !*r.Available || r.Host != "10.0.0.1" || r.Labels["zone"] != "a" || r.Labels["node"] != "node1" {
+		t.Errorf("unexpected ready endpoint %v", r)
+	}
+	if r := reports["api-2_8080"]; *r.Available || *r.Weight != 0 || r.Labels["terminating"] != "true" {
+		t.Errorf("unexpected terminating endpoint %v", r)
+	}
+
+	if err := w.follow(context.Background(), resourceVersion); err != nil {
+		t.Fatalf("clean end of stream should not fail, was %v", err)
+	}
+	reports = w.toReports()
+	if len(reports) != 1 || reports["api-3_8080"].Host != "10.0.0.3" {
+		t.Errorf("modified slice should replace endpoints, was %v", reports)
+	}
+}
+
+func TestWatcherKubernetesBrokenStream(t *testing.T) {
+	server := kubernetesTestServer(t, `{"type": "MODIFIED", "object": {"metadata": `)
+	defer server.Close()
+	w := kubernetesTestWatcher(t, server)
+
+	resourceVersion, err := w.list(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.follow(context.Background(), resourceVersion); err == nil {
+		t.Error("truncated stream should fail")
+	}
+}
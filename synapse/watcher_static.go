@@ -0,0 +1,69 @@
+package synapse
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/blablacar/go-nerve/nerve"
+	"github.com/n0rad/go-erlog/errs"
+	"github.com/n0rad/go-erlog/logs"
+)
+
+type WatcherStatic struct {
+	WatcherCommon
+	Servers []nerve.Report
+
+	staticReports map[string]Report
+}
+
+func NewWatcherStatic() *WatcherStatic {
+	return &WatcherStatic{}
+}
+
+func (w *WatcherStatic) GetServiceName() string {
+	names := []string{}
+	for _, server := range w.Servers {
+		names = append(names, server.Name)
+	}
+	return "static_" + strings.Join(names, "_")
+}
+
+func (w *WatcherStatic) Init(service *Service) error {
+	if err := w.CommonInit(service); err != nil {
+		return errs.WithEF(err, w.fields, "Failed to init discovery")
+	}
+
+	w.staticReports = make(map[string]Report)
+	for i, server := range w.Servers {
+		fields := w.fields.WithField("server", server)
+		if server.Host == "" || server.Port == 0 {
+			return errs.WithF(fields, "host and port are mandatory for static server")
+		}
+		if server.Name == "" {
+			server.Name = server.Host + ":" + strconv.Itoa(int(server.Port))
+		}
+		if _, ok := w.staticReports[server.Name]; ok {
+			return errs.WithF(fields, "Duplicate static server name")
+		}
+		// declaration order is used as creation date for serverSort
+		w.staticReports[server.Name] = Report{Report: server, CreationTime: int64(i)}
+	}
+	return nil
+}
+
+func (w *WatcherStatic) Watch(context *ContextImpl, events chan<- ServiceReport, s *Service) {
+	context.doneWaiter.Add(1)
+	defer context.doneWaiter.Done()
+	w.service.synapse.watcherFailures.WithLabelValues(w.service.Name, PrometheusLabelWatch).Set(0)
+
+	reportsStop := make(chan struct{})
+	go w.changedToReport(reportsStop, events, s)
+
+	logs.WithF(w.fields.WithField("servers", len(w.staticReports))).Debug("Applying static servers")
+	w.reports.replaceAll(w.staticReports)
+
+	<-context.stop
+	logs.WithF(w.fields).Debug("Stopping watcher")
+	close(reportsStop)
+	logs.WithF(w.fields).Debug("Watcher stopped")
+}
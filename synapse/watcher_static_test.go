@@ -0,0 +1,66 @@
+package synapse
+
+import (
+	"testing"
+
+	"github.com/blablacar/go-nerve/nerve"
+)
+
+func TestWatcherStaticInit(t *testing.T) {
+	s := &Synapse{}
+	s.Init("version", "buildtime", true)
+
+	for _, test := range []struct {
+		servers  []nerve.Report
+		fails    bool
+		expected []string
+	}{
+		{[]nerve.Report{{Host: "10.0.0.1", Port: 80}, {Name: "b", Host: "10.0.0.2", Port: 80}}, false, []string{"10.0.0.1:80", "b"}},
+		{[]nerve.Report{}, false, []string{}},
+		{[]nerve.Report{{Name: "a", Port: 80}}, true, nil},
+		{[]nerve.Report{{Name: "a", Host: "10.0.0.1"}}, true, nil},
+		{[]nerve.Report{{Name: "a", Host: "10.0.0.1", Port: 80}, {Name: "a", Host: "10.0.0.2", Port: 80}}, true, nil},
+		{[]nerve.Report{{Host: "10.0.0.1", Port: 80}, {Host: "10.0.0.1", Port: 80}}, true, nil},
+	} {
+		w := NewWatcherStatic()
+		w.Servers = test.servers
+		err := w.Init(&Service{Name: "api", synapse: s})
+		if (err != nil) != test.fails {
+			t.Errorf("unexpected init result for %v: %v", test.servers, err)
+			continue
+		}
+		if test.fails {
+			continue
+		}
+		if len(w.staticReports) != len(test.expected) {
+			t.Errorf("servers should be %v, was %v", test.expected, w.staticReports)
+		}
+		for i, name := range test.expected {
+			if r, ok := w.staticReports[name]; !ok || r.CreationTime != int64(i) {
+				t.Errorf("%s should be created at %d, was %v", name, i, w.staticReports)
+			}
+		}
+	}
+}
+
+func TestWatcherStaticWatch(t *testing.T) {
+	s := &Synapse{}
+	s.Init("version", "buildtime", true)
+	w := NewWatcherStatic()
+	w.Servers = []nerve.Report{{Name: "a", Host: "10.0.0.1", Port: 80}, {Name: "b", Host: "10.0.0.2", Port: 80}}
+	service := &Service{Name: "api", synapse: s}
+	if err := w.Init(service); err != nil {
+		t.Fatal(err)
+	}
+
+	context := newContext(false)
+	events := make(chan ServiceReport, 1)
+	go w.Watch(context, events, service)
+	report := <-events
+	close(context.stop)
+	context.doneWaiter.Wait()
+
+	if report.Service != service || len(report.Reports) != 2 {
+		t.Errorf("static servers should be reported, was %v", report)
+	}
+}
@@ -0,0 +1,88 @@
+package synapse
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWatcherContentFailures(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Consul-Index", "42")
+		w.Write([]byte(`{"items": [`))
+	}))
+	defer server.Close()
+
+	s := &Synapse{}
+	s.Init("version", "buildtime", true)
+
+	httpWatcher := NewWatcherHttp()
+	httpWatcher.Url = server.URL
+	consulWatcher := NewWatcherConsul()
+	consulWatcher.Address = server.URL
+	consulWatcher.Service = "api"
+	kubernetesWatcher := NewWatcherKubernetes()
+	kubernetesWatcher.ApiServer = server.URL
+	kubernetesWatcher.Service = "api"
+	dockerWatcher := NewWatcherDocker()
+	dockerWatcher.Host = "tcp://" + strings.TrimPrefix(server.URL, "http://")
+	dockerWatcher.Label = "service=api"
+	etcdWatcher := NewWatcherEtcd()
+	etcdWatcher.Endpoints = []string{server.URL}
+	etcdWatcher.Prefix = "/services/api/"
+	execWatcher := NewWatcherExec()
+	execWatcher.Command = []string{"true"}
+
+	for _, test := range []struct {
+		name    string
+		watcher Watcher
+		read    func() error
+	}{
+		{"http", httpWatcher, func() error {
+			_, _, err := httpWatcher.poll()
+			return err
+		}},
+		{"consul", consulWatcher, func() error {
+			_, _, err := consulWatcher.query(context.Background(), 12)
+			return err
+		}},
+		{"kubernetes", kubernetesWatcher, func() error {
+			_, err := kubernetesWatcher.list(context.Background())
+			return err
+		}},
+		{"docker", dockerWatcher, func() error {
+			return dockerWatcher.list(context.Background())
+		}},
+		{"etcd", etcdWatcher, func() error {
+			_, err := etcdWatcher.list(context.Background())
+			return err
+		}},
+		{"exec", execWatcher, func() error {
+			go func() {
+				for range execWatcher.reports.changed {
+				}
+			}()
+			return execWatcher.processOutput(bytes.NewReader(make([]byte, 11*1024*1024)))
+		}},
+	} {
+		service := "content_" + test.name
+		if err := test.watcher.Init(&Service{Name: service, synapse: s}); err != nil {
+			t.Fatal(err)
+		}
+		content := watcherFailureCount(s, service, PrometheusLabelContent)
+		watch := watcherFailureCount(s, service, PrometheusLabelWatch)
+
+		err := test.read()
+		if _, ok := err.(watcherContentError); !ok {
+			t.Errorf("%s: invalid content should be a content error, was %v", test.name, err)
+			continue
+		}
+		test.watcher.(interface{ countFailure(error) }).countFailure(err)
+		if watcherFailureCount(s, service, PrometheusLabelContent) != content+1 || watcherFailureCount(s, service, PrometheusLabelWatch) != watch {
+			t.Errorf("%s: invalid content should be counted once as content failure", test.name)
+		}
+	}
+}
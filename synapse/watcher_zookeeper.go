@@ -14,17 +14,22 @@ const PrometheusLabelWatch = "watch"
 
 type WatcherZookeeper struct {
 	WatcherCommon
-	Hosts          []string
-	Path           string
-	TimeoutInMilli int
-
+	Cluster                  string
+	Hosts                    []string
+	Path                     string
+	TimeoutInMilli           int
+	DiscoveryIntervalInMilli int
+	Auth                     *ZookeeperAuth
+
+	authData         []byte
 	connection       *nerve.SharedZkConnection
 	connectionEvents <-chan zk.Event
 }
 
 func NewWatcherZookeeper() *WatcherZookeeper {
 	w := &WatcherZookeeper{
-		TimeoutInMilli: 2000,
+		TimeoutInMilli:           2000,
+		DiscoveryIntervalInMilli: 5000,
 	}
 	return w
 }
@@ -38,7 +43,25 @@ func (w *WatcherZookeeper) Init(service *Service) error {
 		return errs.WithEF(err, w.fields, "Failed to init discovery")
 	}
 	w.fields = w.fields.WithField("path", w.Path)
+	if w.DiscoveryIntervalInMilli <= 0 {
+		return errs.WithF(w.fields.WithField("discoveryIntervalInMilli", w.DiscoveryIntervalInMilli), "DiscoveryIntervalInMilli must be positive")
+	}
+
+	if w.Cluster != "" {
+		return w.initFromCluster()
+	}
 
+	if w.Auth != nil {
+		authData, err := w.Auth.credentials()
+		if err != nil {
+			return errs.WithEF(err, w.fields, "Invalid zookeeper auth")
+		}
+		w.authData = authData
+	}
+
+	if err := w.service.synapse.registerZookeeperSessionAuth(w.Hosts, w.Auth, w.authData); err != nil {
+		return errs.WithEF(err, w.fields, "Invalid zookeeper auth")
+	}
 	conn, err := nerve.NewSharedZkConnection(w.Hosts, time.Duration(w.TimeoutInMilli)*time.Millisecond)
 	if err != nil {
 		return errs.WithEF(err, w.fields, "Failed to prepare connection to zookeeper")
@@ -48,11 +71,57 @@ func (w *WatcherZookeeper) Init(service *Service) error {
 	return nil
 }
 
+func (w *WatcherZookeeper) initFromCluster() error {
+	w.fields = w.fields.WithField("cluster", w.Cluster)
+	cluster, ok := w.service.synapse.ZookeeperClusters[w.Cluster]
+	if !ok {
+		return errs.WithF(w.fields, "Unknown zookeeper cluster")
+	}
+	if len(w.Hosts) > 0 {
+		return errs.WithF(w.fields, "Hosts cannot be set with a zookeeper cluster")
+	}
+	if w.Auth == nil {
+		w.Auth = cluster.Auth
+	}
+	if w.Auth != nil {
+		authData, err := w.Auth.credentials()
+		if err != nil {
+			return errs.WithEF(err, w.fields, "Invalid zookeeper auth")
+		}
+		w.authData = authData
+	}
+
+	if err := w.service.synapse.registerZookeeperSessionAuth(cluster.Hosts, w.Auth, w.authData); err != nil {
+		return errs.WithEF(err, w.fields, "Invalid zookeeper auth")
+	}
+
+	w.connection = cluster.connection
+	w.connectionEvents = w.connection.Subscribe()
+	return nil
+}
+
 func (w *WatcherZookeeper) Watch(context *ContextImpl, events chan<- ServiceReport, s *Service) {
 	context.doneWaiter.Add(1)
 	defer context.doneWaiter.Done()
 	w.service.synapse.watcherFailures.WithLabelValues(w.service.Name, PrometheusLabelWatch).Set(0)
 
+	if w.Auth != nil {
+		w.service.synapse.watcherFailures.WithLabelValues(w.service.Name, PrometheusLabelAuth).Set(0)
+		sessionStop := make(chan struct{})
+		sessionStopWaiter := sync.WaitGroup{}
+		go w.watchSession(sessionStop, &sessionStopWaiter)
+		defer func() {
+			close(sessionStop)
+			sessionStopWaiter.Wait()
+		}()
+	}
+
+	if w.isGlob() {
+		w.watchGlob(context, events)
+		w.connection.Close()
+		return
+	}
+
 	reportsStop := make(chan struct{})
 	go w.changedToReport(reportsStop, events, s)
 
@@ -76,9 +145,9 @@ func (w *WatcherZookeeper) watchRoot(stop <-chan struct{}, doneWaiter *sync.Wait
 	for {
 		childs, _, rootEvents, err := w.connection.Conn.ChildrenW(w.Path)
 		if err != nil {
-			w.service.synapse.watcherFailures.WithLabelValues(w.service.Name, PrometheusLabelWatch).Inc()
-			logs.WithEF(err, w.fields.WithField("path", w.Path)).Warn("Cannot watch root service path. Retry in 1s")
-			<-time.After(time.Duration(1000) * time.Millisecond)
+			delay := w.failureDelay(err)
+			logs.WithEF(err, w.fields.WithField("path", w.Path).WithField("retry", delay)).Warn("Cannot watch root service path")
+			<-time.After(delay)
 
 			if isStopped(stop) {
 				return
@@ -134,9 +203,9 @@ func (w *WatcherZookeeper) watchNode(node string, stop <-chan struct{}, doneWait
 				w.reports.removeNode(node)
 				return
 			}
-			w.service.synapse.watcherFailures.WithLabelValues(w.service.Name, PrometheusLabelWatch).Inc()
-			logs.WithEF(err, fields).Warn("Failed to watch node, retry in 1s")
-			<-time.After(time.Duration(1000) * time.Millisecond)
+			delay := w.failureDelay(err)
+			logs.WithEF(err, fields.WithField("retry", delay)).Warn("Failed to watch node")
+			<-time.After(delay)
 
 			if isStopped(stop) {
 				return
@@ -144,7 +213,7 @@ func (w *WatcherZookeeper) watchNode(node string, stop <-chan struct{}, doneWait
 			continue
 		}
 
-		w.reports.addRawReport(node, content, fields, stats.Ctime)
+		w.reports.addRawReport(node, content, fields, stats.Ctime, stats.Mtime)
 
 		//if context.oneshot {
 		//	go func() {
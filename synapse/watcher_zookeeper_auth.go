@@ -0,0 +1,143 @@
+package synapse
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+	"github.com/n0rad/go-erlog/logs"
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+const PrometheusLabelAuth = "auth"
+
+const ZK_AUTH_DIGEST = "digest"
+
+// credentials do not come back by themselves, no need to retry as fast as other failures
+const zkAuthRetryDelay = 10 * time.Second
+
+type ZookeeperAuth struct {
+	Scheme       string
+	User         string
+	Password     string
+	PasswordFile string
+	PasswordEnv  string
+}
+
+func (a *ZookeeperAuth) credentials() ([]byte, error) {
+	fields := data.WithField("scheme", a.Scheme).WithField("user", a.User)
+	if a.Scheme == "" {
+		a.Scheme = ZK_AUTH_DIGEST
+	}
+	if a.Scheme != ZK_AUTH_DIGEST {
+		return nil, errs.WithF(fields, "Unsupported zookeeper auth scheme")
+	}
+	if a.User == "" {
+		return nil, errs.WithF(fields, "User is mandatory for zookeeper digest auth")
+	}
+
+	password := a.Password
+	if a.PasswordFile != "" {
+		content, err := ioutil.ReadFile(a.PasswordFile)
+		if err != nil {
+			return nil, errs.WithEF(err, fields.WithField("file", a.PasswordFile), "Failed to read zookeeper password file")
+		}
+		password = strings.TrimSpace(string(content))
+	} else if a.PasswordEnv != "" {
+		password = os.Getenv(a.PasswordEnv)
+	}
+	if password == "" {
+		return nil, errs.WithF(fields, "Zookeeper password is empty")
+	}
+	return []byte(a.User + ":" + password), nil
+}
+
+// nerve shares zookeeper sessions by host list and credentials are added to the session,
+// so all watchers of a session must use the same ones to not get the rights of each other
+func (s *Synapse) registerZookeeperSessionAuth(hosts []string, auth *ZookeeperAuth, authData []byte) error {
+	sorted := append([]string{}, hosts...)
+	sort.Strings(sorted)
+	session := strings.Join(sorted, ",")
+	credentials := ""
+	if auth != nil {
+		credentials = auth.Scheme + ":" + string(authData)
+	}
+
+	s.zookeeperAuthsMutex.Lock()
+	defer s.zookeeperAuthsMutex.Unlock()
+	if s.zookeeperAuths == nil {
+		s.zookeeperAuths = make(map[string]string)
+	}
+	if current, ok := s.zookeeperAuths[session]; ok && current != credentials {
+		return errs.WithF(data.WithField("hosts", session), "Zookeeper hosts are already used with other credentials")
+	}
+	s.zookeeperAuths[session] = credentials
+	return nil
+}
+
+// vendored zk client does not resend auth when the session is recreated
+func (w *WatcherZookeeper) watchSession(stop <-chan struct{}, doneWaiter *sync.WaitGroup) {
+	doneWaiter.Add(1)
+	defer doneWaiter.Done()
+
+	if w.connection.Conn.State() == zk.StateHasSession {
+		w.authenticate()
+	}
+	for {
+		select {
+		case e, ok := <-w.connectionEvents:
+			if !ok {
+				return
+			}
+			if e.Type != zk.EventSession {
+				continue
+			}
+			switch e.State {
+			case zk.StateHasSession:
+				w.authenticate()
+			case zk.StateAuthFailed:
+				w.service.synapse.watcherFailures.WithLabelValues(w.service.Name, PrometheusLabelAuth).Inc()
+				logs.WithF(w.fields).Error("Zookeeper authentication failed")
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (w *WatcherZookeeper) authenticate() {
+	if err := w.connection.Conn.AddAuth(w.Auth.Scheme, w.authData); err != nil {
+		w.service.synapse.watcherFailures.WithLabelValues(w.service.Name, PrometheusLabelAuth).Inc()
+		logs.WithEF(err, w.fields.WithField("user", w.Auth.User)).Error("Failed to authenticate to zookeeper")
+		return
+	}
+	logs.WithF(w.fields.WithField("user", w.Auth.User)).Debug("Authenticated to zookeeper")
+}
+
+// counts the failure and gives the delay before retrying
+func (w *WatcherZookeeper) failureDelay(err error) time.Duration {
+	label := w.failureLabel(err)
+	w.service.synapse.watcherFailures.WithLabelValues(w.service.Name, label).Inc()
+	if label != PrometheusLabelAuth {
+		return time.Second
+	}
+	if w.Auth != nil {
+		w.authenticate()
+	}
+	return zkAuthRetryDelay
+}
+
+func (w *WatcherZookeeper) failureLabel(err error) string {
+	if e, ok := err.(*errs.EntryError); ok && len(e.Errs) > 0 {
+		return w.failureLabel(e.Errs[0])
+	}
+	if err == zk.ErrNoAuth || err == zk.ErrAuthFailed {
+		return PrometheusLabelAuth
+	}
+	return PrometheusLabelWatch
+}
@@ -0,0 +1,105 @@
+package synapse
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/n0rad/go-erlog/errs"
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+func TestZookeeperAuthCredentials(t *testing.T) {
+	file, err := ioutil.TempFile("", "synapse-zk-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("fromfile\n")
+	file.Close()
+
+	os.Setenv("SYNAPSE_TEST_ZK_PASSWORD", "fromenv")
+	defer os.Unsetenv("SYNAPSE_TEST_ZK_PASSWORD")
+
+	for _, test := range []struct {
+		auth     ZookeeperAuth
+		expected string
+	}{
+		{ZookeeperAuth{User: "synapse", Password: "secret"}, "synapse:secret"},
+		{ZookeeperAuth{User: "synapse", PasswordFile: file.Name()}, "synapse:fromfile"},
+		{ZookeeperAuth{User: "synapse", PasswordEnv: "SYNAPSE_TEST_ZK_PASSWORD"}, "synapse:fromenv"},
+		{ZookeeperAuth{User: "synapse"}, ""},
+		{ZookeeperAuth{Password: "secret"}, ""},
+		{ZookeeperAuth{Scheme: "sasl", User: "synapse", Password: "secret"}, ""},
+	} {
+		res, err := test.auth.credentials()
+		if test.expected == "" && err == nil {
+			t.Errorf("%v should fail", test.auth)
+		} else if test.expected != "" && string(res) != test.expected {
+			t.Errorf("%v should give %s, was %s (%v)", test.auth, test.expected, res, err)
+		}
+	}
+}
+
+func TestZookeeperFailureLabel(t *testing.T) {
+	w := NewWatcherZookeeper()
+	if l := w.failureLabel(errs.WithE(zk.ErrNoAuth, "Failed")); l != PrometheusLabelAuth {
+		t.Errorf("no auth should be reported as %s, was %s", PrometheusLabelAuth, l)
+	}
+	if l := w.failureLabel(zk.ErrNoNode); l != PrometheusLabelWatch {
+		t.Errorf("no node should be reported as %s, was %s", PrometheusLabelWatch, l)
+	}
+}
+
+func TestZookeeperSharedSessionAuth(t *testing.T) {
+	s := &Synapse{
+		ZookeeperClusters: map[string]*ZookeeperCluster{
+			"main": {Hosts: []string{"127.0.0.1:2", "127.0.0.1:1"}},
+		},
+	}
+	if err := s.Init("version", "buildtime", true); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		cluster string
+		hosts   []string
+		auth    *ZookeeperAuth
+		fails   bool
+	}{
+		{"", []string{"127.0.0.1:1", "127.0.0.1:2"}, &ZookeeperAuth{User: "a", Password: "secret"}, false},
+		{"main", nil, &ZookeeperAuth{User: "a", Password: "secret"}, false},
+		{"main", nil, &ZookeeperAuth{User: "b", Password: "secret"}, true},
+		{"", []string{"127.0.0.1:2", "127.0.0.1:1"}, &ZookeeperAuth{User: "a", Password: "other"}, true},
+		{"", []string{"127.0.0.1:1", "127.0.0.1:2"}, nil, true},
+		{"", []string{"127.0.0.1:3"}, nil, false},
+		{"", []string{"127.0.0.1:3"}, &ZookeeperAuth{User: "a", Password: "secret"}, true},
+	} {
+		w := NewWatcherZookeeper()
+		w.Cluster = test.cluster
+		w.Hosts = test.hosts
+		w.Auth = test.auth
+		w.Path = "/services/api"
+		if err := w.Init(&Service{Name: "api", synapse: s}); (err != nil) != test.fails {
+			t.Errorf("unexpected init result for %v %v: %v", test.hosts, test.auth, err)
+		}
+	}
+}
+
+func TestZookeeperFailureDelay(t *testing.T) {
+	s := &Synapse{}
+	s.Init("version", "buildtime", true)
+	w := NewWatcherZookeeper()
+	w.Hosts = []string{"127.0.0.1:4"}
+	w.Path = "/services/api"
+	if err := w.Init(&Service{Name: "api", synapse: s}); err != nil {
+		t.Fatal(err)
+	}
+	if delay := w.failureDelay(zk.ErrNoAuth); delay != zkAuthRetryDelay {
+		t.Errorf("auth failure should be retried after %s, was %s", zkAuthRetryDelay, delay)
+	}
+	if delay := w.failureDelay(zk.ErrConnectionClosed); delay != time.Second {
+		t.Errorf("watch failure should be retried after 1s, was %s", delay)
+	}
+}
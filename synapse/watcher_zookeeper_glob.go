@@ -0,0 +1,245 @@
+package synapse
+
+import (
+	"bytes"
+	"encoding/json"
+	"path"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/blablacar/go-nerve/nerve"
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+	"github.com/n0rad/go-erlog/logs"
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+const PrometheusLabelTemplate = "template"
+
+// data available to templated service name and routerOptions
+type ServiceTemplateData struct {
+	Name     string
+	Path     string
+	Segments []string
+	Content  string
+	Data     map[string]interface{}
+	Labels   map[string]string
+}
+
+// zookeeper reads of services discovery, *zk.Conn in production
+type zookeeperReader interface {
+	Children(path string) ([]string, *zk.Stat, error)
+	Get(path string) ([]byte, *zk.Stat, error)
+}
+
+type globService struct {
+	service *Service
+	context *ContextImpl
+}
+
+func (w *WatcherZookeeper) isGlob() bool {
+	return strings.ContainsAny(w.Path, "*?[")
+}
+
+func (w *WatcherZookeeper) watchGlob(context *ContextImpl, events chan<- ServiceReport) {
+	services := make(map[string]globService)
+	defer func() {
+		for _, child := range services {
+			close(child.context.stop)
+			child.context.doneWaiter.Wait()
+		}
+	}()
+
+	for {
+		matches, err := w.globMatches(w.connection.Conn)
+		if err != nil {
+			w.service.synapse.watcherFailures.WithLabelValues(w.service.Name, w.failureLabel(err)).Inc()
+			logs.WithEF(err, w.fields).Warn("Failed to discover services. Keeping current ones")
+		} else {
+			for match := range matches {
+				if _, ok := services[match]; ok {
+					continue
+				}
+				service, err := w.newServiceFromTemplate(match)
+				if err != nil {
+					w.service.synapse.watcherFailures.WithLabelValues(w.service.Name, PrometheusLabelTemplate).Inc()
+					logs.WithEF(err, w.fields.WithField("match", match)).Error("Failed to create service from template")
+					continue
+				}
+				w.service.router.addService(service)
+				child := globService{service: service, context: newContext(context.oneshot)}
+				services[match] = child
+				go service.typedWatcher.Watch(child.context, events, service)
+			}
+
+			for match, child := range services {
+				if _, ok := matches[match]; ok {
+					continue
+				}
+				logs.WithF(child.service.fields.WithField("path", match)).Info("Service path disappeared")
+				close(child.context.stop)
+				child.context.doneWaiter.Wait()
+				delete(services, match)
+				if err := w.service.router.removeService(child.service); err != nil {
+					logs.WithEF(err, child.service.fields).Error("Failed to remove service from router")
+				}
+			}
+		}
+
+		select {
+		case <-time.After(time.Duration(w.DiscoveryIntervalInMilli) * time.Millisecond):
+		case <-context.stop:
+			logs.WithF(w.fields).Debug("Stopping services discovery")
+			return
+		}
+	}
+}
+
+func (w *WatcherZookeeper) globMatches(conn zookeeperReader) (map[string]struct{}, error) {
+	paths := []string{""}
+	for _, segment := range strings.Split(strings.Trim(w.Path, "/"), "/") {
+		next := []string{}
+		for _, p := range paths {
+			if !strings.ContainsAny(segment, "*?[") {
+				next = append(next, p+"/"+segment)
+				continue
+			}
+			parent := p
+			if parent == "" {
+				parent = "/"
+			}
+			childs, _, err := conn.Children(parent)
+			if err == zk.ErrNoNode {
+				continue
+			} else if err != nil {
+				return nil, errs.WithEF(err, w.fields.WithField("node", p), "Failed to list children")
+			}
+			for _, child := range childs {
+				if ok, _ := path.Match(segment, child); ok {
+					next = append(next, p+"/"+child)
+				}
+			}
+		}
+		paths = next
+	}
+
+	matches := make(map[string]struct{})
+	for _, p := range paths {
+		matches[p] = struct{}{}
+	}
+	return matches, nil
+}
+
+// public configuration of the template is copied, so new fields of services are never forgotten
+func (w *WatcherZookeeper) newServiceFromTemplate(match string) (*Service, error) {
+	fields := w.fields.WithField("match", match)
+	tmpl := w.service
+
+	watcher := make(map[string]interface{})
+	if err := json.Unmarshal(tmpl.Watcher, &watcher); err != nil {
+		return nil, errs.WithEF(err, fields, "Failed to read template watcher")
+	}
+	watcher["path"] = match
+	rawWatcher, err := json.Marshal(watcher)
+	if err != nil {
+		return nil, errs.WithEF(err, fields, "Failed to prepare watcher")
+	}
+
+	templateData, err := w.templateData(w.connection.Conn, match)
+	if err != nil {
+		return nil, err
+	}
+
+	name := templateData.Name
+	if tmpl.Name != w.GetServiceName() {
+		if name, err = renderServiceTemplate("name", tmpl.Name, templateData); err != nil {
+			return nil, errs.WithEF(err, fields, "Failed to template service name")
+		}
+	}
+	routerOptions, err := renderServiceTemplate("routerOptions", string(tmpl.RouterOptions), templateData)
+	if err != nil {
+		return nil, errs.WithEF(err, fields, "Failed to template routerOptions")
+	}
+
+	service, err := cloneServiceConfig(tmpl)
+	if err != nil {
+		return nil, errs.WithEF(err, fields, "Failed to copy template")
+	}
+	service.Name = name
+	service.Watcher = rawWatcher
+	service.RouterOptions = json.RawMessage(routerOptions)
+	if err := service.Init(tmpl.router, tmpl.synapse); err != nil {
+		return nil, errs.WithEF(err, fields, "Failed to init service from template")
+	}
+	return service, nil
+}
+
+func cloneServiceConfig(service *Service) (*Service, error) {
+	content, err := json.Marshal(service)
+	if err != nil {
+		return nil, err
+	}
+	clone := &Service{}
+	if err := json.Unmarshal(content, clone); err != nil {
+		return nil, err
+	}
+	return clone, nil
+}
+
+func (w *WatcherZookeeper) templateData(conn zookeeperReader, match string) (ServiceTemplateData, error) {
+	fields := w.fields.WithField("match", match)
+	templateData := ServiceTemplateData{
+		Name:     strings.Replace(match, "/", "_", -1)[1:],
+		Path:     match,
+		Segments: strings.Split(strings.Trim(match, "/"), "/"),
+		Labels:   make(map[string]string),
+	}
+
+	content, _, err := conn.Get(match)
+	if err != nil {
+		return templateData, errs.WithEF(err, fields, "Failed to read service node")
+	}
+	templateData.Content = strings.TrimSpace(string(content))
+	if len(content) > 0 {
+		if err := json.Unmarshal(content, &templateData.Data); err != nil {
+			logs.WithEF(err, fields).Trace("Service node content is not a json object")
+		}
+	}
+
+	// labels of the first server, for services declaring their routing in nerve
+	childs, _, err := conn.Children(match)
+	if err != nil {
+		return templateData, errs.WithEF(err, fields, "Failed to list servers")
+	}
+	for _, child := range childs {
+		content, _, err := conn.Get(match + "/" + child)
+		if err != nil {
+			continue
+		}
+		if report, err := nerve.NewReport(content); err == nil && report.Labels != nil {
+			templateData.Labels = report.Labels
+			break
+		}
+	}
+	return templateData, nil
+}
+
+func renderServiceTemplate(name string, content string, templateData ServiceTemplateData) (string, error) {
+	if content == "" {
+		return "", nil
+	}
+	tmpl, err := template.New(name).Funcs(TemplateFunctions).Option("missingkey=error").Parse(content)
+	if err != nil {
+		return "", errs.WithEF(err, data.WithField("template", content), "Failed to parse template")
+	}
+	var buff bytes.Buffer
+	if err := tmpl.Execute(&buff, templateData); err != nil {
+		return "", errs.WithEF(err, data.WithField("template", content), "Failed to execute template")
+	}
+	res := buff.String()
+	if strings.Contains(res, "<no value>") {
+		return "", errs.WithF(data.WithField("content", res), "templating has <no value>")
+	}
+	return res, nil
+}
@@ -0,0 +1,163 @@
+package synapse
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// zookeeper tree in memory, by node path
+type zookeeperTestReader map[string]string
+
+func (z zookeeperTestReader) Children(path string) ([]string, *zk.Stat, error) {
+	if _, ok := z[path]; !ok && path != "/" {
+		return nil, nil, zk.ErrNoNode
+	}
+	prefix := strings.TrimSuffix(path, "/") + "/"
+	childs := []string{}
+	for node := range z {
+		if strings.HasPrefix(node, prefix) && !strings.Contains(node[len(prefix):], "/") {
+			childs = append(childs, node[len(prefix):])
+		}
+	}
+	sort.Strings(childs)
+	return childs, nil, nil
+}
+
+func (z zookeeperTestReader) Get(path string) ([]byte, *zk.Stat, error) {
+	content, ok := z[path]
+	if !ok {
+		return nil, nil, zk.ErrNoNode
+	}
+	return []byte(content), nil, nil
+}
+
+var zookeeperTestTree = zookeeperTestReader{
+	"/services":                  "",
+	"/services/api":              `{"port": 8080}`,
+	"/services/api/server1":      `{"host": "10.0.0.1", "port": 8080, "labels": {"team": "core"}}`,
+	"/services/api-v2":           "",
+	"/services/db":               "mysql",
+	"/services/db/server1":       `{"host": "10.0.0.2", "port": 3306}`,
+	"/other":                     "",
+	"/other/services":            "",
+	"/other/services/web":        "",
+	"/other/services/web/public": "",
+}
+
+func TestWatcherZookeeperGlobMatches(t *testing.T) {
+	for _, test := range []struct {
+		path     string
+		expected []string
+	}{
+		{"/services/*", []string{"/services/api", "/services/api-v2", "/services/db"}},
+		{"/services/api*", []string{"/services/api", "/services/api-v2"}},
+		{"/services/d?", []string{"/services/db"}},
+		{"/services/[ab]*", []string{"/services/api", "/services/api-v2"}},
+		{"/*/services/*", []string{"/other/services/web"}},
+		{"/*/services/*/public", []string{"/other/services/web/public"}},
+		{"/missing/*", []string{}},
+	} {
+		w := &WatcherZookeeper{Path: test.path}
+		matches, err := w.globMatches(zookeeperTestTree)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := []string{}
+		for match := range matches {
+			res = append(res, match)
+		}
+		sort.Strings(res)
+		if !reflect.DeepEqual(res, test.expected) {
+			t.Errorf("%s should match %v, was %v", test.path, test.expected, res)
+		}
+	}
+}
+
+func TestWatcherZookeeperTemplateData(t *testing.T) {
+	for _, test := range []struct {
+		match    string
+		expected ServiceTemplateData
+	}{
+		{"/services/api", ServiceTemplateData{
+			Name:     "services_api",
+			Path:     "/services/api",
+			Segments: []string{"services", "api"},
+			Content:  `{"port": 8080}`,
+			Data:     map[string]interface{}{"port": float64(8080)},
+			Labels:   map[string]string{"team": "core"},
+		}},
+		{"/services/db", ServiceTemplateData{
+			Name:     "services_db",
+			Path:     "/services/db",
+			Segments: []string{"services", "db"},
+			Content:  "mysql",
+			Labels:   map[string]string{},
+		}},
+	} {
+		w := &WatcherZookeeper{}
+		res, err := w.templateData(zookeeperTestTree, test.match)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(res, test.expected) {
+			t.Errorf("unexpected template data of %s: %v", test.match, res)
+		}
+	}
+
+	if _, err := (&WatcherZookeeper{}).templateData(zookeeperTestTree, "/services/missing"); err == nil {
+		t.Error("missing node should fail")
+	}
+}
+
+func TestRenderServiceTemplate(t *testing.T) {
+	templateData := ServiceTemplateData{
+		Name:     "services_api",
+		Segments: []string{"services", "api"},
+		Data:     map[string]interface{}{"port": 8080},
+		Labels:   map[string]string{"team": "core"},
+	}
+	for _, test := range []struct {
+		content  string
+		expected string
+		fails    bool
+	}{
+		{"", "", false},
+		{"{{.Name}}", "services_api", false},
+		{"{{index .Segments 1}}-{{.Labels.team}}", "api-core", false},
+		{`{"bind": "127.0.0.1:{{.Data.port}}"}`, `{"bind": "127.0.0.1:8080"}`, false},
+		{"{{.Data.missing}}", "", true},
+		{"{{.Name", "", true},
+	} {
+		res, err := renderServiceTemplate("test", test.content, templateData)
+		if (err != nil) != test.fails {
+			t.Errorf("unexpected error for %s: %v", test.content, err)
+		}
+		if res != test.expected {
+			t.Errorf("%s should render %s, was %s", test.content, test.expected, res)
+		}
+	}
+}
+
+func TestCloneServiceConfig(t *testing.T) {
+	tmpl := &Service{
+		Name:              "{{.Name}}",
+		MinHealthyPercent: 50,
+		FlapDamping:       &FlapDamping{SuppressThreshold: 3},
+		NoActiveServer:    NoActiveServer{Policy: "keepLast"},
+		id:                42,
+	}
+	clone, err := cloneServiceConfig(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clone.Name != tmpl.Name || clone.MinHealthyPercent != 50 || clone.NoActiveServer.Policy != "keepLast" || clone.id != 0 {
+		t.Errorf("unexpected clone %v", clone)
+	}
+	if clone.FlapDamping == tmpl.FlapDamping || clone.FlapDamping.SuppressThreshold != 3 {
+		t.Errorf("flapDamping should be copied, was %v", clone.FlapDamping)
+	}
+}
@@ -0,0 +1,61 @@
+package synapse
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/blablacar/go-nerve/nerve"
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+)
+
+// zookeeper ensemble shared by watchers referencing it by name
+type ZookeeperCluster struct {
+	Hosts          []string
+	TimeoutInMilli int
+	Auth           *ZookeeperAuth
+
+	name       string
+	fields     data.Fields
+	connection *nerve.SharedZkConnection
+}
+
+type ZookeeperClusterStatus struct {
+	Hosts     []string `json:"hosts"`
+	Server    string   `json:"server"`
+	State     string   `json:"state"`
+	SessionId string   `json:"sessionId"`
+}
+
+func (z *ZookeeperCluster) Init(name string) error {
+	z.name = name
+	z.fields = data.WithField("zookeeperCluster", name)
+	if len(z.Hosts) == 0 {
+		return errs.WithF(z.fields, "Hosts are mandatory for zookeeper cluster")
+	}
+	if z.TimeoutInMilli == 0 {
+		z.TimeoutInMilli = 2000
+	}
+	if z.Auth != nil {
+		if _, err := z.Auth.credentials(); err != nil {
+			return errs.WithEF(err, z.fields, "Invalid zookeeper auth")
+		}
+	}
+
+	conn, err := nerve.NewSharedZkConnection(z.Hosts, time.Duration(z.TimeoutInMilli)*time.Millisecond)
+	if err != nil {
+		return errs.WithEF(err, z.fields, "Failed to prepare connection to zookeeper")
+	}
+	z.connection = conn
+	return nil
+}
+
+func (z *ZookeeperCluster) Status() ZookeeperClusterStatus {
+	status := ZookeeperClusterStatus{Hosts: z.Hosts}
+	if z.connection != nil {
+		status.Server = z.connection.Conn.Server()
+		status.State = z.connection.Conn.State().String()
+		status.SessionId = fmt.Sprintf("0x%x", z.connection.Conn.SessionID())
+	}
+	return status
+}
@@ -0,0 +1,38 @@
+package synapse
+
+import "testing"
+
+func TestZookeeperClusterSharedByWatchers(t *testing.T) {
+	s := &Synapse{
+		ZookeeperClusters: map[string]*ZookeeperCluster{
+			"main": {Hosts: []string{"127.0.0.1:1"}},
+		},
+	}
+	if err := s.Init("version", "buildtime", true); err != nil {
+		t.Fatal(err)
+	}
+
+	w1 := NewWatcherZookeeper()
+	w1.Cluster = "main"
+	w1.Path = "/services/a"
+	w2 := NewWatcherZookeeper()
+	w2.Cluster = "main"
+	w2.Path = "/services/b"
+	for _, w := range []*WatcherZookeeper{w1, w2, w1} {
+		if err := w.Init(&Service{Name: w.Path, synapse: s}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if w1.connection != s.ZookeeperClusters["main"].connection || w2.connection != w1.connection {
+		t.Error("watchers of a cluster should share the cluster connection")
+	}
+	if status := s.ZookeeperClusters["main"].Status(); status.State == "" || status.SessionId == "" {
+		t.Errorf("cluster status should be filled, was %v", status)
+	}
+
+	unknown := NewWatcherZookeeper()
+	unknown.Cluster = "other"
+	if err := unknown.Init(&Service{Name: "unknown", synapse: s}); err == nil {
+		t.Error("unknown cluster should fail")
+	}
+}